@@ -0,0 +1,122 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dnsname
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	// maxLabelLength is the maximum length of a single label, in octets
+	maxLabelLength = 63
+
+	// maxNameLength is the maximum length of a name in presentation format,
+	// in octets, excluding the trailing dot
+	maxNameLength = 253
+)
+
+// profile maps and validates names as idna.Lookup does, but with
+// nontransitional processing, so that deviation characters such as ß are kept
+// rather than mapped to ss, and the same name is published under either
+// encoding. Nontransitional processing is the default; idna.Transitional is
+// not used because the vendored x/net enables it regardless of its argument.
+var profile = idna.New(idna.MapForLookup(), idna.BidiRule())
+
+// Encoding controls how names containing non-ASCII characters are published
+type Encoding string
+
+const (
+	// Punycode publishes internationalized names in their ASCII-compatible
+	// (xn--) form, as used by unicast DNS
+	Punycode Encoding = "punycode"
+
+	// UTF8 publishes internationalized names as raw UTF-8, which is permitted
+	// by multicast DNS (RFC 6762, section 16)
+	UTF8 Encoding = "utf8"
+)
+
+// ParseEncoding converts s to an Encoding
+func ParseEncoding(s string) (Encoding, error) {
+	switch enc := Encoding(strings.ToLower(s)); enc {
+	case Punycode, UTF8:
+		return enc, nil
+	}
+	return "", fmt.Errorf("unknown hostname encoding %q (options: %s, %s)", s, Punycode, UTF8)
+}
+
+// Normalize validates name and converts it to the given encoding. The returned
+// name is lower case and does not have a trailing dot. An error describing why
+// the name was rejected is returned if it cannot be published.
+func Normalize(name string, enc Encoding) (string, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return "", fmt.Errorf("hostname is empty")
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if err := checkLabelCharacters(label); err != nil {
+			return "", fmt.Errorf("hostname %q: %v", name, err)
+		}
+	}
+
+	var normalized string
+	var err error
+	switch enc {
+	case UTF8:
+		normalized, err = profile.ToUnicode(name)
+	default:
+		normalized, err = profile.ToASCII(name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("hostname %q is not a valid internationalized domain name: %v", name, err)
+	}
+
+	if len(normalized) > maxNameLength {
+		return "", fmt.Errorf("hostname %q is %d octets long, exceeding the maximum of %d", normalized, len(normalized), maxNameLength)
+	}
+	for _, label := range strings.Split(normalized, ".") {
+		if len(label) > maxLabelLength {
+			return "", fmt.Errorf("hostname %q: label %q is %d octets long, exceeding the maximum of %d", normalized, label, len(label), maxLabelLength)
+		}
+	}
+
+	return normalized, nil
+}
+
+// checkLabelCharacters verifies a label is non-empty, only contains letters,
+// digits, and hyphens, and does not begin or end with a hyphen
+func checkLabelCharacters(label string) error {
+	if label == "" {
+		return fmt.Errorf("empty label")
+	}
+	if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+		return fmt.Errorf("label %q begins or ends with a hyphen", label)
+	}
+
+	for _, r := range label {
+		switch {
+		case r == '-':
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+		case r > unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)):
+		default:
+			return fmt.Errorf("label %q contains invalid character %q", label, r)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package dnsname
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		enc      Encoding
+		want     string
+		wantFail bool
+	}{
+		{name: "nas.local", enc: Punycode, want: "nas.local"},
+		{name: "NAS.Local.", enc: Punycode, want: "nas.local"},
+		{name: "bücher.local", enc: Punycode, want: "xn--bcher-kva.local"},
+		{name: "bücher.local", enc: UTF8, want: "bücher.local"},
+		{name: "xn--bcher-kva.local", enc: UTF8, want: "bücher.local"},
+		{name: "xn--bcher-kva.local", enc: Punycode, want: "xn--bcher-kva.local"},
+		{name: "straße.local", enc: Punycode, want: "xn--strae-oqa.local"},
+		{name: "straße.local", enc: UTF8, want: "straße.local"},
+		{name: "", enc: Punycode, wantFail: true},
+		{name: "my_host.local", enc: Punycode, wantFail: true},
+		{name: "my host.local", enc: UTF8, wantFail: true},
+		{name: "-host.local", enc: Punycode, wantFail: true},
+		{name: "host-.local", enc: UTF8, wantFail: true},
+		{name: "host..local", enc: Punycode, wantFail: true},
+		{name: strings.Repeat("a", 63) + ".local", enc: Punycode, want: strings.Repeat("a", 63) + ".local"},
+		{name: strings.Repeat("a", 64) + ".local", enc: Punycode, wantFail: true},
+		{name: strings.Repeat("ü", 32) + ".local", enc: UTF8, wantFail: true},
+		{name: strings.Repeat(strings.Repeat("a", 63)+".", 3) + strings.Repeat("a", 61), enc: Punycode, want: strings.Repeat(strings.Repeat("a", 63)+".", 3) + strings.Repeat("a", 61)},
+		{name: strings.Repeat(strings.Repeat("a", 63)+".", 3) + strings.Repeat("a", 62), enc: Punycode, wantFail: true},
+	}
+	for _, tt := range tests {
+		got, err := Normalize(tt.name, tt.enc)
+		if tt.wantFail {
+			if err == nil {
+				t.Errorf("Normalize(%q, %s) = %q, want an error", tt.name, tt.enc, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Normalize(%q, %s) = %q, %v, want %q", tt.name, tt.enc, got, err, tt.want)
+		}
+	}
+}
+
+func TestNormalizeRoundTrip(t *testing.T) {
+	for _, name := range []string{"nas.local", "bücher.local", "straße.local", "日本.local", "café-bar.home.arpa"} {
+		ascii, err := Normalize(name, Punycode)
+		if err != nil {
+			t.Fatalf("Normalize(%q, punycode): %v", name, err)
+		}
+		unicode, err := Normalize(ascii, UTF8)
+		if err != nil {
+			t.Fatalf("Normalize(%q, utf8): %v", ascii, err)
+		}
+		if unicode != name {
+			t.Errorf("%q round trips through %q to %q", name, ascii, unicode)
+		}
+		if back, err := Normalize(unicode, Punycode); err != nil || back != ascii {
+			t.Errorf("%q round trips through %q to %q, %v", ascii, unicode, back, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/blake/external-mdns/resource"
+)
+
+// defaultFQDNTemplates reproduce the names published before templates were
+// configurable.
+//
+// Records are published as <name>.<namespace>.<domain> and as
+// <name>-<namespace>.<domain> because Windows does not support subdomain
+// resolution via mDNS and uses a regular DNS query instead. A short
+// <name>.<domain> record is published in addition when WithoutNamespace is set.
+var defaultFQDNTemplates = []string{
+	"{{.Name}}.{{.Namespace}}.{{.Domain}}",
+	"{{.Name}}-{{.Namespace}}.{{.Domain}}",
+	"{{if .WithoutNamespace}}{{.Name}}.{{.Domain}}{{end}}",
+}
+
+// fqdnTemplateData is the data against which FQDN templates are evaluated
+type fqdnTemplateData struct {
+	Name             string // Hostname from an annotation or Ingress rule, or the Service name
+	Namespace        string // Namespace of the Kubernetes object
+	ObjectName       string // Name of the Kubernetes object
+	SourceType       string // Source the object was discovered by, e.g. service, ingress, or pod
+	Domain           string // Domain in which records are published
+	WithoutNamespace bool   // Whether a name without the namespace should be published
+}
+
+// sampleFQDNTemplateData is evaluated by each template at startup, so that
+// templates referring to unknown fields are rejected before any object is seen
+var sampleFQDNTemplateData = fqdnTemplateData{
+	Name:             "example",
+	Namespace:        "default",
+	ObjectName:       "example",
+	SourceType:       "service",
+	Domain:           "local",
+	WithoutNamespace: true,
+}
+
+// parseFQDNTemplates compiles each of the given templates, and verifies they
+// can be evaluated
+func parseFQDNTemplates(texts []string) ([]*template.Template, error) {
+	templates := make([]*template.Template, 0, len(texts))
+	for _, text := range texts {
+		tmpl, err := template.New("fqdn").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FQDN template %q: %v", text, err)
+		}
+		if err := tmpl.Execute(io.Discard, sampleFQDNTemplateData); err != nil {
+			return nil, fmt.Errorf("invalid FQDN template %q: %v", text, err)
+		}
+		templates = append(templates, tmpl)
+	}
+	return templates, nil
+}
+
+// fqdnsForName evaluates each FQDN template for a single name of r. Templates
+// which evaluate to an empty string are skipped. Cluster-scoped objects, which
+// have no namespace, are only published as <name>.<domain>.
+func fqdnsForName(r resource.Resource, name string) ([]string, error) {
+	if r.Namespace == "" {
+		return []string{name + "." + domain}, nil
+	}
+
+	data := fqdnTemplateData{
+		Name:       name,
+		Namespace:  r.Namespace,
+		ObjectName: r.ObjectName,
+		SourceType: r.SourceType,
+		Domain:     domain,
+		// Publish names without the namespace if any of the following
+		// criteria is satisfied:
+		// 1. The Service exists in the default namespace
+		// 2. The without-namespace annotation is set to true, or the record
+		//    is from an Ingress without the annotation
+		// 3. The -without-namespace flag is equal to true
+		WithoutNamespace: r.Namespace == defaultNamespace || r.WithoutNamespace || withoutNamespace,
+	}
+
+	var fqdns []string
+	for _, tmpl := range fqdnTemplates {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("unable to evaluate FQDN template for %q: %v", name, err)
+		}
+		if fqdn := strings.TrimSpace(buf.String()); fqdn != "" {
+			fqdns = append(fqdns, fqdn)
+		}
+	}
+	return fqdns, nil
+}
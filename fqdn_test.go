@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/blake/external-mdns/resource"
+)
+
+// baselineNames returns the names published for r before FQDN templates were
+// configurable
+func baselineNames(r resource.Resource, flagWithoutNamespace bool) []string {
+	var names []string
+	for _, name := range r.Names {
+		names = append(names, name+"."+r.Namespace+".local", name+"-"+r.Namespace+".local")
+		if r.Namespace == "default" || r.WithoutNamespace || flagWithoutNamespace || r.SourceType == "ingress" {
+			names = append(names, name+".local")
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDefaultFQDNTemplates(t *testing.T) {
+	templates, err := parseFQDNTemplates(defaultFQDNTemplates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fqdnTemplates, domain, defaultNamespace = templates, "local", "default"
+	defer func() { withoutNamespace = false }()
+
+	tests := []struct {
+		name             string
+		resource         resource.Resource
+		withoutNamespace bool
+	}{
+		{
+			name:     "service in default namespace",
+			resource: resource.Resource{SourceType: "service", ObjectName: "nas", Names: []string{"nas"}, Namespace: "default"},
+		},
+		{
+			name:     "service in other namespace",
+			resource: resource.Resource{SourceType: "service", ObjectName: "nas", Names: []string{"nas"}, Namespace: "home"},
+		},
+		{
+			name:     "without-namespace annotation",
+			resource: resource.Resource{SourceType: "service", ObjectName: "nas", Names: []string{"nas", "files"}, Namespace: "home", WithoutNamespace: true},
+		},
+		{
+			name:             "without-namespace flag",
+			resource:         resource.Resource{SourceType: "service", ObjectName: "nas", Names: []string{"nas"}, Namespace: "home"},
+			withoutNamespace: true,
+		},
+		{
+			// Ingress hosts default to being published without the namespace
+			name:     "ingress",
+			resource: resource.Resource{SourceType: "ingress", ObjectName: "web", Names: []string{"app", "docs"}, Namespace: "home", WithoutNamespace: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withoutNamespace = tt.withoutNamespace
+
+			var got []string
+			for _, name := range tt.resource.Names {
+				fqdns, err := fqdnsForName(tt.resource, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, fqdns...)
+			}
+			sort.Strings(got)
+
+			if want := baselineNames(tt.resource, tt.withoutNamespace); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -3,10 +3,15 @@ module github.com/blake/external-mdns
 go 1.16
 
 require (
-	github.com/jpillora/go-tld v1.0.0
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/miekg/dns v1.1.31
 	github.com/mitchellh/copystructure v1.0.0
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/prometheus/client_golang v1.9.0
+	github.com/prometheus/common v0.18.0 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	golang.org/x/net v0.0.0-20210520170846-37e1c6afe023
+	golang.org/x/sync v0.0.0-20220907140024-f12130a52804 // indirect
 	k8s.io/api v0.22.2
 	k8s.io/apimachinery v0.22.2
 	k8s.io/client-go v0.22.2
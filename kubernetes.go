@@ -20,6 +20,10 @@ import (
 	"path/filepath"
 
 	homedir "github.com/mitchellh/go-homedir"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -67,3 +71,40 @@ func newK8sClient() (*kubernetes.Clientset, error) {
 	}
 	return k8sClient, nil
 }
+
+func newDynamicClient() (dynamic.Interface, error) {
+	// Creates a client for resources without generated types, such as those of
+	// the Gateway API
+	return dynamic.NewForConfig(initAuthCreds())
+}
+
+// newInformerFactories returns an informer factory scoped to each namespace,
+// keyed by that namespace. A single factory watches all namespaces if any of
+// namespaces is metav1.NamespaceAll.
+func newInformerFactories(client kubernetes.Interface, namespaces []string) map[string]informers.SharedInformerFactory {
+	factories := make(map[string]informers.SharedInformerFactory, len(namespaces))
+	for _, namespace := range namespaces {
+		if namespace == metav1.NamespaceAll {
+			return map[string]informers.SharedInformerFactory{
+				metav1.NamespaceAll: informers.NewSharedInformerFactory(client, 0),
+			}
+		}
+		factories[namespace] = informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(namespace))
+	}
+	return factories
+}
+
+// newDynamicInformerFactories returns a dynamic informer factory scoped to each
+// namespace, keyed by that namespace, in the same way as newInformerFactories.
+func newDynamicInformerFactories(client dynamic.Interface, namespaces []string) map[string]dynamicinformer.DynamicSharedInformerFactory {
+	factories := make(map[string]dynamicinformer.DynamicSharedInformerFactory, len(namespaces))
+	for _, namespace := range namespaces {
+		if namespace == metav1.NamespaceAll {
+			return map[string]dynamicinformer.DynamicSharedInformerFactory{
+				metav1.NamespaceAll: dynamicinformer.NewDynamicSharedInformerFactory(client, 0),
+			}
+		}
+		factories[namespace] = dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, namespace, nil)
+	}
+	return factories
+}
@@ -21,10 +21,18 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
+	"github.com/blake/external-mdns/dnsname"
 	"github.com/blake/external-mdns/mdns"
 	"github.com/blake/external-mdns/resource"
 	"github.com/blake/external-mdns/source"
+	"github.com/miekg/dns"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/informers"
 )
@@ -37,12 +45,24 @@ func (s *k8sSource) String() string {
 
 func (s *k8sSource) Set(value string) error {
 	switch value {
-	case "ingress", "service":
+	case "ingress", "service", "pod", "node", "gateway":
 		*s = append(*s, value)
 	}
 	return nil
 }
 
+// stringSlice is a flag which may be specified multiple times
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 /*
 The following functions were obtained from
 https://www.gmarik.info/blog/2019/12-factor-golang-flag-package/
@@ -68,6 +88,18 @@ func lookupEnvOrString(key string, defaultVal string) string {
 	return defaultVal
 }
 
+// lookupEnvOrStringSlice returns values if the flag was specified, or else the
+// comma-separated values of the environment variable key, or else defaultVal
+func lookupEnvOrStringSlice(values []string, key string, defaultVal []string) []string {
+	if len(values) > 0 {
+		return values
+	}
+	if val, ok := os.LookupEnv(key); ok {
+		return strings.Split(val, ",")
+	}
+	return defaultVal
+}
+
 func lookupEnvOrInt(key string, defaultVal int) int {
 	if val, ok := os.LookupEnv(key); ok {
 		v, err := strconv.Atoi(val)
@@ -79,6 +111,17 @@ func lookupEnvOrInt(key string, defaultVal int) int {
 	return defaultVal
 }
 
+func lookupEnvOrDuration(key string, defaultVal time.Duration) time.Duration {
+	if val, ok := os.LookupEnv(key); ok {
+		v, err := time.ParseDuration(val)
+		if err != nil {
+			log.Fatalf("lookupEnvOrDuration[%s]: %v", key, err)
+		}
+		return v
+	}
+	return defaultVal
+}
+
 func lookupEnvOrBool(key string, defaultVal bool) bool {
 	if val, ok := os.LookupEnv(key); ok {
 		v, err := strconv.ParseBool(val)
@@ -122,8 +165,48 @@ func reverseAddress(addr string) (arpa string, err error) {
 	return string(buf), nil
 }
 
-func constructRecords(r resource.Resource) []string {
-	var records []string
+// recordHeader returns the header for a record of type rrtype published under
+// the given name with the given TTL
+func recordHeader(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+}
+
+// constructRecords builds the address, pointer, and CNAME records to publish
+// for r. Hostnames which cannot be published are skipped and reported in the
+// returned error, alongside the records for the remaining hostnames.
+func constructRecords(r resource.Resource) ([]dns.RR, error) {
+	var records []dns.RR
+	var errs []error
+
+	ttl := uint32(recordTTL)
+	if r.TTL != 0 {
+		ttl = r.TTL
+	}
+
+	var hostnames []string
+	for _, name := range r.Names {
+		fqdns, err := fqdnsForName(r, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		hostnames = append(hostnames, fqdns...)
+	}
+
+	validHostnames := make([]string, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		normalized, err := dnsname.Normalize(hostname, hostnameEncoding)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		validHostnames = append(validHostnames, dns.Fqdn(normalized))
+	}
 
 	for _, resourceIP := range r.IPs {
 		ip := net.ParseIP(resourceIP)
@@ -131,77 +214,80 @@ func constructRecords(r resource.Resource) []string {
 			continue
 		}
 
+		ip4 := ip.To4()
+		if (ip4 != nil && !exposeIPv4) || (ip4 == nil && !exposeIPv6) {
+			continue
+		}
+
 		reverseIP, _ := reverseAddress(resourceIP)
 
-		var recordType string
-		if ip.To4() != nil {
-			if !exposeIPv4 {
-				continue
+		for _, hostname := range validHostnames {
+			if ip4 != nil {
+				records = append(records, &dns.A{Hdr: recordHeader(hostname, dns.TypeA, ttl), A: ip4})
+			} else {
+				records = append(records, &dns.AAAA{Hdr: recordHeader(hostname, dns.TypeAAAA, ttl), AAAA: ip})
 			}
-			recordType = "A"
-		} else {
-			if !exposeIPv6 {
-				continue
-			}
-			recordType = "AAAA"
-		}
 
-		// Publish records resources as <name>.<namespace>.local and as <name>-<namespace>.local
-		// Because Windows does not support subdomains resolution via mDNS and uses regular DNS query instead.
-		// Ensure corresponding PTR records map to this hostname
-		// To maintain backwards compatibility, without-namespace annontation still generates these records
-		for _, name := range r.Names {
-			records = append(records, fmt.Sprintf("%s.%s.local. %d IN %s %s", name, r.Namespace, recordTTL, recordType, ip))
-			records = append(records, fmt.Sprintf("%s-%s.local. %d IN %s %s", name, r.Namespace, recordTTL, recordType, ip))
 			if reverseIP != "" {
-				records = append(records, fmt.Sprintf("%s %d IN PTR %s.%s.local.", reverseIP, recordTTL, name, r.Namespace))
-				records = append(records, fmt.Sprintf("%s %d IN PTR %s-%s.local.", reverseIP, recordTTL, name, r.Namespace))
+				records = append(records, &dns.PTR{Hdr: recordHeader(reverseIP, dns.TypePTR, ttl), Ptr: hostname})
 			}
 		}
+	}
 
-		// Publish services without the name in the namespace if any of the following
-		// criteria is satisfied:
-		// 1. The Service exists in the default namespace
-		// 2. Service names exposed with annotation and with additional without-namespace annotation set to true
-		// 3. The -without-namespace flag is equal to true
-		// 4. The record to be published is from an Ingress with a defined hostname
-		if r.Namespace == defaultNamespace || r.WithoutNamespace || withoutNamespace || r.SourceType == "ingress" {
-			for _, name := range r.Names {
-				records = append(records, fmt.Sprintf("%s.local. %d IN %s %s", name, recordTTL, recordType, ip))
-				if reverseIP != "" {
-					records = append(records, fmt.Sprintf("%s %d IN PTR %s.local.", reverseIP, recordTTL, name))
-				}
+	// A name with a CNAME record may have no other records, and only one
+	// CNAME, so the first target is only published when there are no IPs
+	if len(r.IPs) == 0 && len(r.Targets) > 0 {
+		// Targets are normalized like published names, so that a target which
+		// is itself published matches its records
+		target, err := dnsname.Normalize(r.Targets[0], hostnameEncoding)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CNAME target: %v", err))
+		} else {
+			for _, hostname := range validHostnames {
+				records = append(records, &dns.CNAME{Hdr: recordHeader(hostname, dns.TypeCNAME, ttl), Target: dns.Fqdn(target)})
 			}
 		}
 	}
 
-	return records
-}
-
-func publishRecord(rr string) {
-	if err := mdns.Publish(rr); err != nil {
-		log.Fatalf(`Unable to publish record "%s": %v`, rr, err)
-	}
-}
-
-func unpublishRecord(rr string) {
-	if err := mdns.UnPublish(rr); err != nil {
-		log.Fatalf(`Unable to publish record "%s": %v`, rr, err)
-	}
+	return records, utilerrors.NewAggregate(errs)
 }
 
 var (
-	master           = ""
-	namespace        = ""
-	defaultNamespace = "default"
-	withoutNamespace = false
-	test             = flag.Bool("test", false, "testing mode, no connection to k8s")
-	sourceFlag       k8sSource
-	kubeconfig       string
-	exposeIPv4       = true
-	exposeIPv6       = false
-	publishInternal  = flag.Bool("publish-internal-services", false, "Publish DNS records for ClusterIP services (optional)")
-	recordTTL        = 120
+	master              = ""
+	namespaces          stringSlice
+	excludeNamespaces   stringSlice
+	namespaceSelector   = ""
+	labelFilter         = ""
+	annotationFilter    = ""
+	optIn               = false
+	ingressClasses      stringSlice
+	ingressControllers  stringSlice
+	publishService      = ""
+	lbHostnameMode      = source.HostnameResolve
+	lbHostnameRefresh   = 5 * time.Minute
+	publishNodePorts    = false
+	nodeSelector        = ""
+	nodeSourceSelector  = ""
+	publishHeadless     = false
+	requireReady        = false
+	publishExternalName = false
+	defaultNamespace    = "default"
+	withoutNamespace    = false
+	test                = flag.Bool("test", false, "testing mode, no connection to k8s")
+	sourceFlag          k8sSource
+	kubeconfig          string
+	exposeIPv4          = true
+	exposeIPv6          = false
+	publishInternal     = false
+	recordTTL           = 120
+	metricsAddress      = ":7979"
+	hostnameEncoding    = dnsname.Punycode
+	fqdnTemplateText    stringSlice
+	fqdnTemplates       []*template.Template
+	domain              = "local"
+	remapDomains        stringSlice
+	resyncInterval      = time.Minute
+	workers             = 2
 )
 
 func main() {
@@ -213,17 +299,100 @@ func main() {
 	// External-mDNS options
 	flag.StringVar(&defaultNamespace, "default-namespace", lookupEnvOrString("EXTERNAL_MDNS_DEFAULT_NAMESPACE", defaultNamespace), "Namespace in which services should also be published with a shorter entry")
 	flag.BoolVar(&withoutNamespace, "without-namespace", lookupEnvOrBool("EXTERNAL_MDNS_WITHOUT_NAMESPACE", withoutNamespace), "Published with a shorter entry without namespace (default: false)")
-	flag.StringVar(&namespace, "namespace", lookupEnvOrString("EXTERNAL_MDNS_NAMESPACE", namespace), "Limit sources of endpoints to a specific namespace (default: all namespaces)")
-	flag.Var(&sourceFlag, "source", "The resource types that are queried for endpoints; specify multiple times for multiple sources (required, options: service, ingress)")
+	flag.Var(&namespaces, "namespace", "Limit sources of endpoints to a specific namespace; specify multiple times for multiple namespaces (default: all namespaces)")
+	flag.Var(&excludeNamespaces, "exclude-namespace", "Do not publish records for objects in this namespace; specify multiple times for multiple namespaces (optional)")
+	flag.StringVar(&namespaceSelector, "namespace-selector", lookupEnvOrString("EXTERNAL_MDNS_NAMESPACE_SELECTOR", namespaceSelector), "Only publish records for objects in namespaces whose labels match this selector, e.g. mdns=enabled (optional)")
+	flag.StringVar(&labelFilter, "label-filter", lookupEnvOrString("EXTERNAL_MDNS_LABEL_FILTER", labelFilter), "Only publish records for objects whose labels match this selector (optional)")
+	flag.StringVar(&annotationFilter, "annotation-filter", lookupEnvOrString("EXTERNAL_MDNS_ANNOTATION_FILTER", annotationFilter), "Only publish records for objects whose annotations match this selector (optional)")
+	flag.Var(&ingressClasses, "ingress-class", "Only publish records for Ingresses of this class; specify multiple times for multiple classes (optional)")
+	flag.Var(&ingressControllers, "ingress-controller", "Only publish records for Ingresses whose IngressClass names this controller, e.g. k8s.io/ingress-nginx; specify multiple times for multiple controllers (optional)")
+	flag.StringVar(&publishService, "publish-service", lookupEnvOrString("EXTERNAL_MDNS_PUBLISH_SERVICE", publishService), "Publish Ingress hosts with the load balancer or external IPs of this Service, in the form namespace/name (optional)")
+	hostnameMode := flag.String("lb-hostname-mode", lookupEnvOrString("EXTERNAL_MDNS_LB_HOSTNAME_MODE", string(lbHostnameMode)), "How to publish load balancer entries with only a hostname (options: resolve, cname, ignore)")
+	flag.DurationVar(&lbHostnameRefresh, "lb-hostname-refresh-interval", lookupEnvOrDuration("EXTERNAL_MDNS_LB_HOSTNAME_REFRESH_INTERVAL", lbHostnameRefresh), "Interval at which resolved load balancer hostnames are looked up again")
+	flag.BoolVar(&publishNodePorts, "publish-node-ports", lookupEnvOrBool("EXTERNAL_MDNS_PUBLISH_NODE_PORTS", publishNodePorts), "Publish NodePort Services with the addresses of ready Nodes (default: false)")
+	flag.StringVar(&nodeSelector, "node-selector", lookupEnvOrString("EXTERNAL_MDNS_NODE_SELECTOR", nodeSelector), "Only publish NodePort Services with the addresses of Nodes whose labels match this selector (optional)")
+	flag.StringVar(&nodeSourceSelector, "node-source-selector", lookupEnvOrString("EXTERNAL_MDNS_NODE_SOURCE_SELECTOR", nodeSourceSelector), "Only publish records for Nodes whose labels match this selector (optional)")
+	flag.BoolVar(&publishHeadless, "publish-headless", lookupEnvOrBool("EXTERNAL_MDNS_PUBLISH_HEADLESS", publishHeadless), "Watch EndpointSlices to publish the endpoints of headless Services annotated with "+source.PublishEndpointsAnnotation+"=true (default: false)")
+	flag.BoolVar(&requireReady, "require-ready-endpoints", lookupEnvOrBool("EXTERNAL_MDNS_REQUIRE_READY_ENDPOINTS", requireReady), "Only publish Services which select Pods while at least one endpoint is ready (default: false)")
+	flag.BoolVar(&publishExternalName, "publish-external-name-services", lookupEnvOrBool("EXTERNAL_MDNS_PUBLISH_EXTERNAL_NAME_SERVICES", publishExternalName), "Publish ExternalName Services as CNAME records (default: false)")
+	flag.BoolVar(&optIn, "opt-in", lookupEnvOrBool("EXTERNAL_MDNS_OPT_IN", optIn), "Only publish records for objects annotated with "+source.EnabledAnnotation+"=true (default: false)")
+	flag.Var(&sourceFlag, "source", "The resource types that are queried for endpoints; specify multiple times for multiple sources (required, options: service, ingress, pod, node, gateway)")
 	flag.BoolVar(&exposeIPv4, "expose-ipv4", lookupEnvOrBool("EXTERNAL_MDNS_EXPOSE_IPV4", exposeIPv4), "Publish A DNS entry (default: true)")
+	flag.BoolVar(&publishInternal, "publish-internal-services", publishInternal, "Publish DNS records for ClusterIP services (optional)")
 	flag.BoolVar(&exposeIPv6, "expose-ipv6", lookupEnvOrBool("EXTERNAL_MDNS_EXPOSE_IPV6", exposeIPv6), "Publish AAAA DNS entry (default: false)")
 	flag.IntVar(&recordTTL, "record-ttl", lookupEnvOrInt("EXTERNAL_MDNS_RECORD_TTL", recordTTL), "DNS record time-to-live")
+	flag.StringVar(&domain, "domain", lookupEnvOrString("EXTERNAL_MDNS_DOMAIN", domain), "Domain in which records are published, e.g. local or home.arpa")
+	flag.Var(&remapDomains, "remap-domain", "Also publish Ingress hosts within this domain, replacing it with the published domain; specify multiple times for multiple domains (optional)")
+	flag.Var(&fqdnTemplateText, "fqdn-template", "Go template used to construct the names published for each hostname; specify multiple times for multiple names (default: {{.Name}}.{{.Namespace}}.{{.Domain}}, {{.Name}}-{{.Namespace}}.{{.Domain}}, and {{.Name}}.{{.Domain}} when published without namespace); not applied to Nodes, which are published as <node>.<domain>")
+	encoding := flag.String("hostname-encoding", lookupEnvOrString("EXTERNAL_MDNS_HOSTNAME_ENCODING", string(hostnameEncoding)), "Encoding of internationalized hostnames (options: punycode, utf8)")
+	flag.DurationVar(&resyncInterval, "resync-interval", lookupEnvOrDuration("EXTERNAL_MDNS_RESYNC_INTERVAL", resyncInterval), "Interval at which the records for all Kubernetes objects are reconciled")
+	flag.IntVar(&workers, "workers", lookupEnvOrInt("EXTERNAL_MDNS_WORKERS", workers), "Number of workers reconciling the records of changed Kubernetes objects")
+	flag.StringVar(&metricsAddress, "metrics-address", lookupEnvOrString("EXTERNAL_MDNS_METRICS_ADDRESS", metricsAddress), "Address on which to expose Prometheus metrics and health checks; set to an empty string to disable")
 
 	flag.Parse()
 
+	var err error
+	if hostnameEncoding, err = dnsname.ParseEncoding(*encoding); err != nil {
+		log.Fatalln(err)
+	}
+	if lbHostnameMode, err = source.ParseHostnameMode(*hostnameMode); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Templates may contain commas, so the environment variable holds a single
+	// template rather than a comma-separated list
+	if len(fqdnTemplateText) == 0 {
+		fqdnTemplateText = defaultFQDNTemplates
+		if val, ok := os.LookupEnv("EXTERNAL_MDNS_FQDN_TEMPLATE"); ok {
+			fqdnTemplateText = []string{val}
+		}
+	}
+	if fqdnTemplates, err = parseFQDNTemplates(fqdnTemplateText); err != nil {
+		log.Fatalln(err)
+	}
+
+	domain = strings.Trim(domain, ".")
+	remapDomains = lookupEnvOrStringSlice(remapDomains, "EXTERNAL_MDNS_REMAP_DOMAIN", nil)
+	namespaces = lookupEnvOrStringSlice(namespaces, "EXTERNAL_MDNS_NAMESPACE", []string{metav1.NamespaceAll})
+	excludeNamespaces = lookupEnvOrStringSlice(excludeNamespaces, "EXTERNAL_MDNS_EXCLUDE_NAMESPACE", nil)
+	ingressClasses = lookupEnvOrStringSlice(ingressClasses, "EXTERNAL_MDNS_INGRESS_CLASS", nil)
+	ingressControllers = lookupEnvOrStringSlice(ingressControllers, "EXTERNAL_MDNS_INGRESS_CONTROLLER", nil)
+
+	var selector labels.Selector
+	if namespaceSelector != "" {
+		if selector, err = labels.Parse(namespaceSelector); err != nil {
+			log.Fatalf("Invalid namespace selector %q: %v", namespaceSelector, err)
+		}
+	}
+
+	nodeLabels := labels.Everything()
+	if nodeSelector != "" {
+		if nodeLabels, err = labels.Parse(nodeSelector); err != nil {
+			log.Fatalf("Invalid node selector %q: %v", nodeSelector, err)
+		}
+	}
+
+	nodeSourceLabels := labels.Everything()
+	if nodeSourceSelector != "" {
+		if nodeSourceLabels, err = labels.Parse(nodeSourceSelector); err != nil {
+			log.Fatalf("Invalid node source selector %q: %v", nodeSourceSelector, err)
+		}
+	}
+
+	objectFilter, err := source.NewObjectFilter(labelFilter, annotationFilter, optIn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	if *test {
-		publishRecord("router.local. 60 IN A 192.168.1.254")
-		publishRecord("254.1.168.192.in-addr.arpa. 60 IN PTR router.local.")
+		for _, rr := range []string{
+			"router.local. 60 IN A 192.168.1.254",
+			"254.1.168.192.in-addr.arpa. 60 IN PTR router.local.",
+		} {
+			if err := mdns.Publish(rr); err != nil {
+				log.Fatalf(`Unable to publish record "%s": %v`, rr, err)
+			}
+		}
 
 		select {}
 	}
@@ -242,36 +411,77 @@ func main() {
 		log.Fatalln("Failed to create Kubernetes client:", err)
 	}
 
-	notifyMdns := make(chan resource.Resource)
 	stopper := make(chan struct{})
 	defer close(stopper)
 	defer runtime.HandleCrash()
 
-	factory := informers.NewSharedInformerFactory(k8sClient, 0)
+	rec := newReconciler()
+	factories := newInformerFactories(k8sClient, namespaces)
+	// Cluster-scoped objects are watched using a factory which is not scoped to
+	// a namespace, and which is started once every source has requested its
+	// informers
+	clusterFactory := informers.NewSharedInformerFactory(k8sClient, 0)
+	namespaceFilter := source.NewNamespaceFilter(clusterFactory, excludeNamespaces, selector)
+	hostnames := source.NewHostnameResolver(lbHostnameMode, net.DefaultResolver, lbHostnameRefresh)
+	rec.prune = append(rec.prune, hostnames.Prune)
 	for _, src := range sourceFlag {
+		var controller source.Source
 		switch src {
+		case "gateway":
+			dynClient, err := newDynamicClient()
+			if err != nil {
+				log.Fatalln("Failed to create Kubernetes dynamic client:", err)
+			}
+			controller, err = source.NewGatewayWatcher(newDynamicInformerFactories(dynClient, namespaces), k8sClient.Discovery(), namespaceFilter, objectFilter, hostnames, domain, remapDomains, rec.queue)
+			if err != nil {
+				log.Fatalln(err)
+			}
 		case "ingress":
-			ingressController := source.NewIngressWatcher(factory, namespace, notifyMdns)
-			go ingressController.Run(stopper) //nolint
+			classFilter := source.NewIngressClassFilter(clusterFactory, ingressClasses, ingressControllers)
+			publishSvc, err := source.NewPublishService(k8sClient, publishService, hostnames)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			controller = source.NewIngressWatcher(factories, namespaceFilter, objectFilter, classFilter, publishSvc, hostnames, domain, remapDomains, rec.queue)
+		case "node":
+			controller = source.NewNodeWatcher(clusterFactory, nodeSourceLabels, rec.queue)
+		case "pod":
+			controller = source.NewPodWatcher(factories, namespaceFilter, objectFilter, rec.queue)
 		case "service":
-			serviceController := source.NewServicesWatcher(factory, namespace, notifyMdns, publishInternal)
-			go serviceController.Run(stopper) //nolint
+			nodes := source.NewNodeAddresses(clusterFactory, nodeLabels, publishNodePorts)
+			controller = source.NewServicesWatcher(factories, namespaceFilter, objectFilter, hostnames, nodes, rec.queue, source.ServiceSourceOptions{
+				PublishInternal:     publishInternal,
+				PublishExternalName: publishExternalName,
+				PublishHeadless:     publishHeadless,
+				RequireReady:        requireReady,
+			})
 		}
+		rec.sources[src] = controller
+		readinessChecks = append(readinessChecks, readinessCheck{src, controller.HasSynced})
+		go controller.Run(stopper) //nolint
 	}
+	clusterFactory.Start(stopper)
+	go namespaceFilter.Run(stopper)
+	go hostnames.Run(stopper)
+	readinessChecks = append(readinessChecks, readinessCheck{"reconciler", rec.Ready})
+
+	if metricsAddress != "" {
+		go serveHTTP(metricsAddress)
+	}
+
+	go rec.run(workers, stopper)
+
+	resync := time.NewTicker(resyncInterval)
+	defer resync.Stop()
 
 	for {
 		select {
-		case advertiseResource := <-notifyMdns:
-			for _, record := range constructRecords(advertiseResource) {
-				switch advertiseResource.Action {
-				case resource.Added:
-					log.Printf("Added %s\n", record)
-					publishRecord(record)
-				case resource.Deleted:
-					log.Printf("Remove %s\n", record)
-					unpublishRecord(record)
-				}
+		case <-resync.C:
+			if err := rec.reconcile(); err != nil {
+				log.Printf("Unable to reconcile records: %v\n", err)
 			}
+		case pong := <-loopPing:
+			close(pong)
 		case <-stopper:
 			fmt.Println("Stopping program")
 		}
@@ -3,11 +3,18 @@ package mdns
 // Advertise network services via multicast DNS
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"reflect"
 
+	"github.com/blake/external-mdns/metrics"
 	"github.com/miekg/dns"
 	"github.com/mitchellh/copystructure"
 )
@@ -18,14 +25,21 @@ var (
 	ipv6mcastaddr, _ = net.ResolveUDPAddr("udp6", "[ff02::fb]:5353")
 
 	local *zone // the local mdns zone
+
+	// opTimeout bounds how long publishing or unpublishing a record waits for
+	// the zone's main loop
+	opTimeout = 5 * time.Second
+
+	// maxReadErrors is the number of consecutive failed reads after which a
+	// socket is considered unable to read
+	maxReadErrors int32 = 10
+
+	connectorsMu sync.Mutex
+	connectors   []*connector // sockets the local zone is served on
 )
 
 func init() {
-	local = &zone{
-		entries: make(map[string]entries),
-		op:      make(chan operation),
-		queries: make(chan *query, 16),
-	}
+	local = newZone()
 	go local.mainloop()
 	if err := local.listen(ipv4mcastaddr); err != nil {
 		log.Fatalf("Failed to listen %s: %s", ipv4mcastaddr, err)
@@ -35,14 +49,37 @@ func init() {
 	}
 }
 
+// Change describes the effect of publishing or unpublishing a record on behalf
+// of an owner
+type Change int
+
+const (
+	// Unchanged indicates the owner already held, or did not hold, the record
+	Unchanged Change = iota
+
+	// OwnerChanged indicates the owner was added to or removed from the record,
+	// which was already published and remains published for other owners
+	OwnerChanged
+
+	// RecordChanged indicates the record was published for its first owner, or
+	// withdrawn after its last owner was removed
+	RecordChanged
+)
+
 // Publish adds a record, describewrite tod in RFC XXX
 func Publish(r string) error {
 	rr, err := dns.NewRR(r)
 	if err != nil {
 		return err
 	}
-	local.op <- operation{"add", &entry{rr}}
-	return nil
+	_, err = PublishRR(rr, "")
+	return err
+}
+
+// PublishRR adds a record which has already been parsed on behalf of owner.
+// A record is advertised for as long as it has at least one owner.
+func PublishRR(rr dns.RR, owner string) (Change, error) {
+	return local.apply("add", rr, owner)
 }
 
 // UnPublish removes mDNS advertisement for the given record
@@ -51,21 +88,182 @@ func UnPublish(r string) error {
 	if err != nil {
 		return err
 	}
-	local.op <- operation{"del", &entry{rr}}
+	_, err = UnPublishRR(rr, "")
+	return err
+}
+
+// UnPublishRR removes owner from a record which has already been parsed. The
+// record is no longer advertised once its last owner is removed.
+func UnPublishRR(rr dns.RR, owner string) (Change, error) {
+	return local.apply("del", rr, owner)
+}
+
+// Record is a published record and the owners it is published for
+type Record struct {
+	dns.RR
+	Owners []string
+}
+
+// Records returns a copy of every record in the zone
+func Records() []Record {
+	result := make(chan []Record, 1)
+	local.snapshots <- result
+	return <-result
+}
+
+// Announce multicasts every record in the zone with the given name and type in
+// an unsolicited response, as described in RFC 6762, section 8.3. The
+// cache-flush bit is set so that clients replace any records they have cached
+// for the name and type rather than adding to them.
+func Announce(name string, rrtype uint16) error {
+	rrs := local.query(dns.Question{Name: name, Qtype: rrtype, Qclass: dns.ClassINET})
+	if len(rrs) == 0 {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	msg.MsgHdr.Response = true
+	msg.MsgHdr.Authoritative = true
+	for _, rr := range rrs {
+		rr.Header().Class |= 0x8000
+		msg.Answer = append(msg.Answer, rr.RR)
+	}
+
+	return multicast(msg)
+}
+
+// Goodbye multicasts rrs with a TTL of zero in an unsolicited response, as
+// described in RFC 6762, section 10.1, so that clients promptly remove them
+// from their caches. It should be called once the records are withdrawn. The
+// response is sent from the zone's main loop, omitting any record which has
+// been published again since, so that a concurrent publish by another owner is
+// never flushed from caches.
+func Goodbye(rrs ...dns.RR) error {
+	if len(rrs) == 0 {
+		return nil
+	}
+
+	result := make(chan error, 1)
+	select {
+	case local.goodbyes <- goodbye{rrs, result}:
+	case <-time.After(opTimeout):
+		return fmt.Errorf("zone event loop did not accept goodbye within %s", opTimeout)
+	}
+	return <-result
+}
+
+// multicast sends msg on every open socket
+func multicast(msg *dns.Msg) error {
+	connectorsMu.Lock()
+	defer connectorsMu.Unlock()
+
+	var errs []string
+	for _, c := range connectors {
+		if atomic.LoadInt32(&c.closed) == 1 {
+			continue
+		}
+		if err := c.writeMessage(msg, c.UDPAddr); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", c.UDPAddr, err))
+			continue
+		}
+		metrics.AnswersSent.Add(float64(len(msg.Answer)))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to send announcement: %s", strings.Join(errs, ", "))
+	}
 	return nil
 }
 
+// RecordsFor returns a copy of every record in the zone published for owner
+func RecordsFor(owner string) []dns.RR {
+	return local.recordsFor(owner)
+}
+
 // Clear removes all entries from advertisement
 func Clear() {
-	local.op <- operation{"clr", nil}
+	local.op <- operation{"clr", nil, "", nil}
+}
+
+// Healthy returns an error if the responder is unable to answer queries, either
+// because none of its sockets are able to read, or because the zone's event
+// loop is not responding. A socket is unable to read once it is closed, or
+// after maxReadErrors consecutive reads fail.
+func Healthy(timeout time.Duration) error {
+	connectorsMu.Lock()
+	alive := 0
+	for _, c := range connectors {
+		if c.readable() {
+			alive++
+		}
+	}
+	connectorsMu.Unlock()
+
+	if alive == 0 {
+		return errors.New("no mDNS sockets are able to read")
+	}
+
+	return local.ping(timeout)
 }
 
 type entry struct {
 	dns.RR
+	owners map[string]struct{} // keys of the objects which published the record
 }
 
+// fqdn returns the canonical form of the entry's name, which the zone is keyed
+// by
 func (e *entry) fqdn() string {
-	return e.Header().Name
+	return canonicalName(e.Header().Name)
+}
+
+// canonicalName converts a name in presentation format to the form the zone is
+// keyed by. Names unpacked from the wire escape non-ASCII octets as \DDD,
+// whereas published names may contain raw UTF-8, so escapes are replaced by the
+// octets they stand for. Names are compared case-insensitively for ASCII
+// letters only, as described in RFC 6762, section 16.
+func canonicalName(name string) string {
+	b := []byte(unescapeName(name))
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
+// unescapeName replaces the \DDD and \X escapes in a name with the octets they
+// stand for. Escaped dots and backslashes are kept escaped, since they are
+// part of a label rather than label separators.
+func unescapeName(name string) string {
+	if !strings.Contains(name, `\`) {
+		return name
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '\\' || i+1 == len(name) {
+			b.WriteByte(name[i])
+			continue
+		}
+
+		c := name[i+1]
+		i++
+		if i+2 < len(name) && isDigit(name[i]) && isDigit(name[i+1]) && isDigit(name[i+2]) {
+			if v := int(name[i]-'0')*100 + int(name[i+1]-'0')*10 + int(name[i+2]-'0'); v <= 255 {
+				c = byte(v)
+				i += 2
+			}
+		}
+		if c == '.' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
 }
 
 type query struct {
@@ -77,22 +275,53 @@ type entries []*entry
 
 func (e entries) contains(entry *entry) int {
 	for i, ee := range e {
-		if reflect.DeepEqual(entry, ee) {
+		if reflect.DeepEqual(entry.RR, ee.RR) {
 			return i
 		}
 	}
 	return -1
 }
 
+// entrySet is a set of entries in the zone
+type entrySet map[*entry]struct{}
+
+type ownerQuery struct {
+	owner  string
+	result chan<- []dns.RR
+}
+
 type operation struct {
 	op string // one of add, del, clr
 	*entry
+	owner  string
+	result chan<- Change
+}
+
+type goodbye struct {
+	rrs    []dns.RR
+	result chan<- error
 }
 
 type zone struct {
-	entries map[string]entries
-	op      chan operation
-	queries chan *query // query existing entries in zone
+	entries      map[string]entries
+	owned        map[string]entrySet // entries published by each owner
+	op           chan operation
+	queries      chan *query          // query existing entries in zone
+	ownerQueries chan ownerQuery      // copy the entries published by an owner
+	snapshots    chan chan<- []Record // copy all entries in zone
+	goodbyes     chan goodbye         // multicast withdrawn entries
+}
+
+func newZone() *zone {
+	return &zone{
+		entries:      make(map[string]entries),
+		owned:        make(map[string]entrySet),
+		op:           make(chan operation),
+		queries:      make(chan *query, 16),
+		ownerQueries: make(chan ownerQuery),
+		snapshots:    make(chan chan<- []Record),
+		goodbyes:     make(chan goodbye),
+	}
 }
 
 func (z *zone) mainloop() {
@@ -102,61 +331,239 @@ func (z *zone) mainloop() {
 			entry := op.entry
 			switch op.op {
 			case "add":
-				if z.entries[entry.fqdn()].contains(entry) == -1 {
-					z.entries[entry.fqdn()] = append(z.entries[entry.fqdn()], entry)
-				}
+				op.result <- z.add(entry, op.owner)
 			case "del":
-				entries := z.entries[entry.fqdn()]
-				idx := z.entries[entry.fqdn()].contains(entry)
-				if idx != -1 {
-					numEntries := len(entries)
-					if numEntries == 1 {
-						delete(z.entries, entry.fqdn())
-					} else {
-						// Copy last element to index idx
-						entries[idx] = entries[numEntries-1]
-						// Erase last element (write nil value).
-						entries[numEntries-1] = nil
-						// Truncate slice
-						z.entries[entry.fqdn()] = entries[:numEntries-1]
-					}
-				}
+				op.result <- z.del(entry, op.owner)
 			case "clr":
 				z.entries = make(map[string]entries)
+				z.owned = make(map[string]entrySet)
 			}
 		case q := <-z.queries:
-			for _, entry := range z.entries[q.Question.Name] {
+			for _, entry := range z.entries[canonicalName(q.Question.Name)] {
 				if q.matches(entry) {
 					q.result <- entry
 				}
 			}
 			close(q.result)
+		case q := <-z.ownerQueries:
+			rrs := make([]dns.RR, 0, len(z.owned[q.owner]))
+			for entry := range z.owned[q.owner] {
+				rrs = append(rrs, dns.Copy(entry.RR))
+			}
+			q.result <- rrs
+		case result := <-z.snapshots:
+			result <- z.records()
+		case g := <-z.goodbyes:
+			g.result <- z.goodbye(g.rrs)
 		}
 	}
 }
 
+// goodbye multicasts the records in rrs which are not in the zone with a TTL of
+// zero. It must only be called from the main loop, so that no entry can be
+// added between checking the zone and sending the response.
+func (z *zone) goodbye(rrs []dns.RR) error {
+	withdrawn := z.withdrawn(rrs)
+	if len(withdrawn) == 0 {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	msg.MsgHdr.Response = true
+	msg.MsgHdr.Authoritative = true
+	msg.Answer = withdrawn
+	return multicast(msg)
+}
+
+// withdrawn returns copies of the records in rrs with a TTL of zero, omitting
+// those for which the zone holds an entry with the same name, type and data. A
+// goodbye removes a record from caches whatever its TTL, so an entry published
+// again with a different TTL must still be kept.
+func (z *zone) withdrawn(rrs []dns.RR) []dns.RR {
+	var withdrawn []dns.RR
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = unescapeName(rr.Header().Name)
+		rr.Header().Ttl = 0
+
+		published := false
+		for _, entry := range z.entries[canonicalName(rr.Header().Name)] {
+			if dns.IsDuplicate(entry.RR, rr) {
+				published = true
+				break
+			}
+		}
+		if !published {
+			withdrawn = append(withdrawn, rr)
+		}
+	}
+	return withdrawn
+}
+
+// records copies every entry in the zone
+func (z *zone) records() []Record {
+	var records []Record
+	for _, entries := range z.entries {
+		for _, entry := range entries {
+			owners := make([]string, 0, len(entry.owners))
+			for owner := range entry.owners {
+				owners = append(owners, owner)
+			}
+			records = append(records, Record{RR: dns.Copy(entry.RR), Owners: owners})
+		}
+	}
+	return records
+}
+
+// apply submits an add or del operation to the zone's main loop, returning an
+// error if the main loop does not accept it within opTimeout
+func (z *zone) apply(op string, rr dns.RR, owner string) (Change, error) {
+	if name := unescapeName(rr.Header().Name); name != rr.Header().Name {
+		// Store names in one form, so that they are packed as the same octets
+		// regardless of how they were written
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+	}
+
+	result := make(chan Change, 1)
+	select {
+	case z.op <- operation{op, &entry{RR: rr}, owner, result}:
+	case <-time.After(opTimeout):
+		return Unchanged, fmt.Errorf("zone event loop did not accept %s operation within %s", op, opTimeout)
+	}
+	return <-result, nil
+}
+
+// add publishes entry on behalf of owner
+func (z *zone) add(entry *entry, owner string) Change {
+	idx := z.entries[entry.fqdn()].contains(entry)
+	if idx == -1 {
+		entry.owners = map[string]struct{}{owner: {}}
+		z.entries[entry.fqdn()] = append(z.entries[entry.fqdn()], entry)
+		z.own(owner, entry)
+		return RecordChanged
+	}
+
+	existing := z.entries[entry.fqdn()][idx]
+	if _, ok := existing.owners[owner]; ok {
+		return Unchanged
+	}
+	existing.owners[owner] = struct{}{}
+	z.own(owner, existing)
+	return OwnerChanged
+}
+
+// own adds entry to the entries indexed for owner
+func (z *zone) own(owner string, entry *entry) {
+	if z.owned[owner] == nil {
+		z.owned[owner] = make(entrySet)
+	}
+	z.owned[owner][entry] = struct{}{}
+}
+
+// disown removes entry from the entries indexed for owner
+func (z *zone) disown(owner string, entry *entry) {
+	delete(z.owned[owner], entry)
+	if len(z.owned[owner]) == 0 {
+		delete(z.owned, owner)
+	}
+}
+
+// del removes owner from entry, and removes entry once it has no owners
+func (z *zone) del(entry *entry, owner string) Change {
+	entries := z.entries[entry.fqdn()]
+	idx := entries.contains(entry)
+	if idx == -1 {
+		return Unchanged
+	}
+
+	existing := entries[idx]
+	if _, ok := existing.owners[owner]; !ok {
+		return Unchanged
+	}
+	delete(existing.owners, owner)
+	z.disown(owner, existing)
+	if len(existing.owners) > 0 {
+		return OwnerChanged
+	}
+
+	numEntries := len(entries)
+	if numEntries == 1 {
+		delete(z.entries, entry.fqdn())
+	} else {
+		// Copy last element to index idx
+		entries[idx] = entries[numEntries-1]
+		// Erase last element (write nil value).
+		entries[numEntries-1] = nil
+		// Truncate slice
+		z.entries[entry.fqdn()] = entries[:numEntries-1]
+	}
+	return RecordChanged
+}
+
 func (z *zone) query(q dns.Question) (entries []*entry) {
 	res := make(chan *entry, 16)
 	z.queries <- &query{q, res}
 	for e := range res {
-		dup, err := copystructure.Copy(e)
+		// Only the record is copied, since the owners are modified by the
+		// zone's main loop
+		dup, err := copystructure.Copy(e.RR)
 		if err != nil {
 			return
 		}
-		response := dup.(*entry)
-		entries = append(entries, response)
+		entries = append(entries, &entry{RR: dup.(dns.RR)})
 	}
 	return
 }
 
+// recordsFor copies the records published for owner, using the zone's index
+// of the entries published by each owner
+func (z *zone) recordsFor(owner string) []dns.RR {
+	result := make(chan []dns.RR, 1)
+	z.ownerQueries <- ownerQuery{owner, result}
+	return <-result
+}
+
+// ping verifies the zone's main loop is processing queries
+func (z *zone) ping(timeout time.Duration) error {
+	res := make(chan *entry, 16)
+	deadline := time.After(timeout)
+	select {
+	case z.queries <- &query{dns.Question{Name: "."}, res}:
+	case <-deadline:
+		return fmt.Errorf("zone event loop did not accept a query within %s", timeout)
+	}
+	for {
+		select {
+		case _, ok := <-res:
+			if !ok {
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("zone event loop did not answer a query within %s", timeout)
+		}
+	}
+}
+
 func (q *query) matches(entry *entry) bool {
-	return q.Question.Qtype == dns.TypeANY || q.Question.Qtype == entry.RR.Header().Rrtype
+	// A name with a CNAME record has no other records, so the CNAME answers
+	// questions of any type
+	rrtype := entry.RR.Header().Rrtype
+	return q.Question.Qtype == dns.TypeANY || q.Question.Qtype == rrtype || rrtype == dns.TypeCNAME
 }
 
 type connector struct {
 	*net.UDPAddr
 	*net.UDPConn
 	*zone
+	closed     int32 // set once the socket can no longer be read from
+	readErrors int32 // consecutive failed reads
+}
+
+// readable reports whether the socket is open and its last maxReadErrors reads
+// did not all fail
+func (c *connector) readable() bool {
+	return atomic.LoadInt32(&c.closed) == 0 && atomic.LoadInt32(&c.readErrors) < maxReadErrors
 }
 
 func (z *zone) listen(addr *net.UDPAddr) error {
@@ -171,6 +578,10 @@ func (z *zone) listen(addr *net.UDPAddr) error {
 	}
 	go c.mainloop()
 
+	connectorsMu.Lock()
+	connectors = append(connectors, c)
+	connectorsMu.Unlock()
+
 	return nil
 }
 
@@ -191,6 +602,11 @@ type pkt struct {
 func (c *connector) readloop(in chan pkt) {
 	for {
 		msg, addr, err := c.readMessage()
+		if errors.Is(err, net.ErrClosed) {
+			log.Printf("Socket %s closed, no longer reading", c.UDPAddr)
+			atomic.StoreInt32(&c.closed, 1)
+			return
+		}
 		if err != nil {
 			// log dud packets
 			log.Printf("Could not read from %#v: %s", c.UDPConn, err)
@@ -214,8 +630,26 @@ func (c *connector) mainloop() {
 		// if source port is not 5353 then it's "One-Shot Multicast DNS Query" and we should send unicast response
 		isLegacyUnicast := msg.UDPAddr.Port != 5353
 
-		msg.Answer = make([]dns.RR, 0) // some queries already have an answer, we should not answer them
+		for _, q := range msg.Question {
+			mode := "QM"
+			if q.Qclass&0x8000 > 0 {
+				mode = "QU"
+			}
+			metrics.QueriesReceived.WithLabelValues(dns.TypeToString[q.Qtype], mode).Inc()
+		}
+
+		// https://datatracker.ietf.org/doc/html/rfc6762#section-7.1
+		// Records the querier already knows about are listed in the answer
+		// section of the query and should not be sent again
+		knownAnswers := msg.Answer
+
+		msg.Answer = make([]dns.RR, 0)
 		for _, result := range c.query(msg.Question) {
+			if !isLegacyUnicast && isKnownAnswer(result.RR, knownAnswers) {
+				metrics.SuppressedAnswers.Inc()
+				continue
+			}
+
 			if isLegacyUnicast {
 				// https://datatracker.ietf.org/doc/html/rfc6762#section-6.7
 				// The resource record TTL given in a legacy unicast response SHOULD NOT be greater than ten seconds
@@ -252,9 +686,34 @@ func (c *connector) mainloop() {
 
 			if err := c.writeMessage(msg.Msg, addr); err != nil {
 				log.Println("Cannot send: ", err)
+				continue
 			}
+
+			metrics.AnswersSent.Add(float64(len(msg.Answer)))
+			if isLegacyUnicast {
+				metrics.LegacyUnicastResponses.Inc()
+			}
+		}
+	}
+}
+
+// isKnownAnswer reports whether rr is present in the known-answer list of a
+// query with a TTL of at least half of the true TTL, in which case it must not
+// be sent, as described in RFC 6762, section 7.1
+func isKnownAnswer(rr dns.RR, known []dns.RR) bool {
+	rr = dns.Copy(rr)
+	rr.Header().Name = canonicalName(rr.Header().Name)
+	for _, k := range known {
+		// The cache-flush bit is not part of the record's class, and names
+		// unpacked from the wire may be escaped
+		k = dns.Copy(k)
+		k.Header().Class &^= 0x8000
+		k.Header().Name = canonicalName(k.Header().Name)
+		if dns.IsDuplicate(rr, k) && 2*uint64(k.Header().Ttl) >= uint64(rr.Header().Ttl) {
+			return true
 		}
 	}
+	return false
 }
 
 func (c *connector) query(qs []dns.Question) (results []*entry) {
@@ -266,7 +725,13 @@ func (c *connector) query(qs []dns.Question) (results []*entry) {
 }
 
 // recursively probe for related records
-func (c *connector) findExtra(r ...dns.RR) (extra []dns.RR) {
+func (c *connector) findExtra(r ...dns.RR) []dns.RR {
+	return c.findExtraVisited(make(map[string]struct{}), r...)
+}
+
+// findExtraVisited probes for the records related to r, skipping names which
+// have already been probed so that CNAME loops terminate
+func (c *connector) findExtraVisited(visited map[string]struct{}, r ...dns.RR) (extra []dns.RR) {
 	for _, rr := range r {
 		var q dns.Question
 		switch rr := rr.(type) {
@@ -282,13 +747,27 @@ func (c *connector) findExtra(r ...dns.RR) (extra []dns.RR) {
 				Qtype:  dns.TypeA,
 				Qclass: dns.ClassINET,
 			}
+		case *dns.CNAME:
+			// Include the addresses of a target which is also published
+			q = dns.Question{
+				Name:   rr.Target,
+				Qtype:  dns.TypeANY,
+				Qclass: dns.ClassINET,
+			}
 		default:
 			continue
 		}
+
+		key := canonicalName(q.Name)
+		if _, ok := visited[key]; ok {
+			continue
+		}
+		visited[key] = struct{}{}
+
 		res := c.zone.query(q)
 		if len(res) > 0 {
 			for _, entry := range res {
-				extra = append(append(extra, entry.RR), c.findExtra(entry.RR)...)
+				extra = append(append(extra, entry.RR), c.findExtraVisited(visited, entry.RR)...)
 			}
 		}
 	}
@@ -310,11 +789,16 @@ func (c *connector) readMessage() (*dns.Msg, *net.UDPAddr, error) {
 	buf := make([]byte, 16384)
 	read, addr, err := c.ReadFromUDP(buf)
 	if err != nil {
+		metrics.ReadErrors.WithLabelValues("read").Inc()
+		atomic.AddInt32(&c.readErrors, 1)
 		return nil, nil, err
 	}
+	// Packets which fail to parse were still read from the socket
+	atomic.StoreInt32(&c.readErrors, 0)
 
 	var msg dns.Msg
 	if err := msg.Unpack(buf[:read]); err != nil {
+		metrics.ReadErrors.WithLabelValues("parse").Inc()
 		return nil, nil, err
 	}
 
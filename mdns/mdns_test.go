@@ -0,0 +1,193 @@
+package mdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIsKnownAnswer(t *testing.T) {
+	rr, err := dns.NewRR("nas.local. 120 IN A 192.168.1.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		known string
+		want  bool
+	}{
+		{"full TTL", "nas.local. 120 IN A 192.168.1.10", true},
+		{"half TTL", "nas.local. 60 IN A 192.168.1.10", true},
+		{"below half TTL", "nas.local. 59 IN A 192.168.1.10", false},
+		{"other address", "nas.local. 120 IN A 192.168.1.11", false},
+		{"other name", "printer.local. 120 IN A 192.168.1.10", false},
+		{"name case", "NAS.local. 120 IN A 192.168.1.10", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			known, err := dns.NewRR(tt.known)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := isKnownAnswer(rr, []dns.RR{known}); got != tt.want {
+				t.Errorf("isKnownAnswer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("odd TTL", func(t *testing.T) {
+		rr, _ := dns.NewRR("nas.local. 121 IN A 192.168.1.10")
+		known, _ := dns.NewRR("nas.local. 60 IN A 192.168.1.10")
+		if isKnownAnswer(rr, []dns.RR{known}) {
+			t.Error("a TTL of 60 is less than half of 121, so the answer must be sent")
+		}
+	})
+
+	t.Run("escaped name", func(t *testing.T) {
+		// Known answers unpacked from the wire escape non-ASCII octets
+		rr, _ := dns.NewRR("bücher.local. 120 IN A 192.168.1.10")
+		known := dns.Copy(rr)
+		known.Header().Name = `b\195\188cher.local.`
+		if !isKnownAnswer(rr, []dns.RR{known}) {
+			t.Error("escaped and raw UTF-8 names must be compared in canonical form")
+		}
+	})
+
+	t.Run("cache-flush bit", func(t *testing.T) {
+		known, _ := dns.NewRR("nas.local. 120 IN A 192.168.1.10")
+		known.Header().Class |= 0x8000
+		if !isKnownAnswer(rr, []dns.RR{known}) {
+			t.Error("the cache-flush bit must be ignored when comparing records")
+		}
+	})
+}
+
+func TestQueryUTF8Name(t *testing.T) {
+	z := newZone()
+	go z.mainloop()
+
+	rr, err := dns.NewRR("bücher.local. 120 IN A 192.168.1.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := z.apply("add", rr, "service/default/books"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queries are unpacked from the wire, which escapes non-ASCII octets
+	msg := new(dns.Msg)
+	msg.SetQuestion("Bücher.local.", dns.TypeA)
+	buf, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unpacked dns.Msg
+	if err := unpacked.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	answers := z.query(unpacked.Question[0])
+	if len(answers) != 1 {
+		t.Fatalf("query for %s returned %d answers, want 1", unpacked.Question[0].Name, len(answers))
+	}
+	if name := answers[0].Header().Name; name != "bücher.local." {
+		t.Errorf("answer name = %q, want %q", name, "bücher.local.")
+	}
+}
+
+func TestCanonicalName(t *testing.T) {
+	tests := map[string]string{
+		"NAS.local.":              "nas.local.",
+		`b\195\188cher.local.`:    "bücher.local.",
+		"bücher.local.":           "bücher.local.",
+		`my\.host.local.`:         `my\.host.local.`,
+		`my\046host.local.`:       `my\.host.local.`,
+		`back\\slash.local.`:      `back\\slash.local.`,
+		`B\195\156CHER.LOCAL.`:    "b\xc3\x9ccher.local.",
+		`plain\-escape.local.`:    "plain-escape.local.",
+		`trailing-backslash.\`:    `trailing-backslash.\`,
+		`not\25digits.local.`:     "not25digits.local.",
+		`out\256ofrange.local.`:   "out256ofrange.local.",
+		`already\032space.local.`: "already space.local.",
+	}
+	for name, want := range tests {
+		if got := canonicalName(name); got != want {
+			t.Errorf("canonicalName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRecordsFor(t *testing.T) {
+	z := newZone()
+	go z.mainloop()
+
+	shared, _ := dns.NewRR("nas.local. 120 IN A 192.168.1.10")
+	only, _ := dns.NewRR("printer.local. 120 IN A 192.168.1.20")
+	for _, op := range []struct {
+		op    string
+		rr    dns.RR
+		owner string
+	}{
+		{"add", shared, "service/default/nas"},
+		{"add", shared, "ingress/default/nas"},
+		{"add", only, "service/default/nas"},
+		{"del", shared, "ingress/default/nas"},
+	} {
+		if _, err := z.apply(op.op, op.rr, op.owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := z.recordsFor("service/default/nas"); len(got) != 2 {
+		t.Errorf("service owns %d records, want 2: %v", len(got), got)
+	}
+	if got := z.recordsFor("ingress/default/nas"); len(got) != 0 {
+		t.Errorf("ingress owns %d records after removing its only record, want 0: %v", len(got), got)
+	}
+	if _, ok := z.owned["ingress/default/nas"]; ok {
+		t.Error("owners without records should be removed from the index")
+	}
+}
+
+func TestConnectorReadable(t *testing.T) {
+	c := &connector{}
+	if !c.readable() {
+		t.Fatal("a new socket should be readable")
+	}
+	c.readErrors = maxReadErrors - 1
+	if !c.readable() {
+		t.Errorf("a socket with %d consecutive read errors should be readable", c.readErrors)
+	}
+	c.readErrors = maxReadErrors
+	if c.readable() {
+		t.Errorf("a socket with %d consecutive read errors should not be readable", c.readErrors)
+	}
+	c.readErrors, c.closed = 0, 1
+	if c.readable() {
+		t.Error("a closed socket should not be readable")
+	}
+}
+
+func TestWithdrawn(t *testing.T) {
+	z := newZone()
+	go z.mainloop()
+
+	withdrawn, _ := dns.NewRR("printer.local. 120 IN A 192.168.1.20")
+	republished, _ := dns.NewRR("nas.local. 120 IN A 192.168.1.10")
+	retimed, _ := dns.NewRR("nas.local. 60 IN A 192.168.1.10")
+	if _, err := z.apply("add", retimed, "ingress/default/nas"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := z.withdrawn([]dns.RR{withdrawn, republished})
+	if len(got) != 1 || got[0].Header().Name != "printer.local." {
+		t.Fatalf("withdrawn = %v, want only printer.local.", got)
+	}
+	if got[0].Header().Ttl != 0 {
+		t.Errorf("goodbye TTL = %d, want 0", got[0].Header().Ttl)
+	}
+	if withdrawn.Header().Ttl != 120 {
+		t.Error("withdrawn should not modify its arguments")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "external_mdns"
+
+var (
+	// QueriesReceived counts questions received by the mDNS responder,
+	// partitioned by record type and by whether a unicast (QU) or multicast
+	// (QM) response was requested
+	QueriesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "responder",
+		Name:      "queries_received_total",
+		Help:      "Number of mDNS questions received, by record type and response mode (QU or QM).",
+	}, []string{"type", "mode"})
+
+	// AnswersSent counts resource records sent in responses
+	AnswersSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "responder",
+		Name:      "answers_sent_total",
+		Help:      "Number of resource records sent in mDNS responses.",
+	})
+
+	// LegacyUnicastResponses counts responses sent to one-shot queriers
+	LegacyUnicastResponses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "responder",
+		Name:      "legacy_unicast_responses_total",
+		Help:      "Number of responses sent to legacy unicast (one-shot) queriers.",
+	})
+
+	// SuppressedAnswers counts answers omitted due to known-answer suppression
+	SuppressedAnswers = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "responder",
+		Name:      "suppressed_answers_total",
+		Help:      "Number of answers omitted because the querier already knew them.",
+	})
+
+	// ReadErrors counts packets which could not be read from, or parsed off
+	// of, the wire
+	ReadErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "responder",
+		Name:      "read_errors_total",
+		Help:      "Number of packets that could not be read or parsed, by reason.",
+	}, []string{"reason"})
+
+	// PublishedRecords tracks the number of records currently published,
+	// partitioned by the type of Kubernetes resource they originate from. A
+	// record published by multiple objects is counted once for each object.
+	PublishedRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "published_records",
+		Help:      "Number of records currently published, by source type.",
+	}, []string{"source"})
+
+	// KubernetesEvents counts informer events processed by each source
+	KubernetesEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "kubernetes",
+		Name:      "events_total",
+		Help:      "Number of Kubernetes add, update, and delete events processed, by source type.",
+	}, []string{"source", "event"})
+
+	// InformerSynced reports whether a source's informer cache has synced
+	InformerSynced = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "kubernetes",
+		Name:      "informer_synced",
+		Help:      "Whether the informer cache for a source has synced (1) or not (0).",
+	}, []string{"source"})
+)
+
+// Handler returns an http.Handler which serves metrics in the Prometheus
+// exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
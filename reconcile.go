@@ -0,0 +1,401 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blake/external-mdns/mdns"
+	"github.com/blake/external-mdns/metrics"
+	"github.com/blake/external-mdns/resource"
+	"github.com/blake/external-mdns/source"
+	"github.com/miekg/dns"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// maxRetries is the number of times an owner is retried before its records
+// are left for the next full resync
+const maxRetries = 10
+
+// ownedRecord identifies a record published on behalf of a single owner
+type ownedRecord struct {
+	record string // presentation format of the record
+	owner  string
+}
+
+// reconciler publishes the records desired by each source, and withdraws
+// records which are no longer desired by any source.
+//
+// Sources add the owner key of each object which changes to queue, and
+// workers reconcile the records of that single owner. A full pass over every
+// source is run at startup and on every resync, and excludes workers while it
+// runs.
+type reconciler struct {
+	sources map[string]source.Source
+	queue   workqueue.RateLimitingInterface
+	mu      sync.RWMutex
+	ready   int32 // set once a full pass completes after all sources have synced
+
+	// prune is called once every source has been listed in a full pass, to
+	// drop state which is only referenced by objects which no longer exist
+	prune []func()
+}
+
+func newReconciler() *reconciler {
+	return &reconciler{
+		sources: make(map[string]source.Source),
+		queue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "external-mdns"),
+	}
+}
+
+// Ready reports whether the records for every source have been published
+// since their informer caches synced
+func (r *reconciler) Ready() bool {
+	return atomic.LoadInt32(&r.ready) == 1
+}
+
+// run waits for every source to sync, runs an initial full pass, and then
+// starts workers to process queued owners until stopCh is closed
+func (r *reconciler) run(workers int, stopCh chan struct{}) {
+	defer r.queue.ShutDown()
+
+	hasSynced := make([]cache.InformerSynced, 0, len(r.sources))
+	for _, src := range r.sources {
+		hasSynced = append(hasSynced, src.HasSynced)
+	}
+	if !cache.WaitForCacheSync(stopCh, hasSynced...) {
+		runtime.HandleError(fmt.Errorf("timed out waiting for sources to sync"))
+		return
+	}
+
+	if err := r.reconcile(); err != nil {
+		log.Printf("Unable to reconcile records: %v\n", err)
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(r.runWorker, time.Second, stopCh)
+	}
+	<-stopCh
+}
+
+func (r *reconciler) runWorker() {
+	for r.processNextItem() {
+	}
+}
+
+func (r *reconciler) processNextItem() bool {
+	key, quit := r.queue.Get()
+	if quit {
+		return false
+	}
+	defer r.queue.Done(key)
+
+	err := r.syncOwner(key.(string))
+	switch {
+	case err == nil:
+		r.queue.Forget(key)
+	case r.queue.NumRequeues(key) < maxRetries:
+		log.Printf("Unable to reconcile records for %s, retrying: %v\n", key, err)
+		r.queue.AddRateLimited(key)
+	default:
+		log.Printf("Unable to reconcile records for %s, giving up until next resync: %v\n", key, err)
+		r.queue.Forget(key)
+	}
+	return true
+}
+
+// syncOwner reconciles the records published for a single owner with the
+// records desired by its source
+func (r *reconciler) syncOwner(owner string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sourceType, namespace, name, err := resource.SplitOwnerKey(owner)
+	if err != nil {
+		return err
+	}
+	src, ok := r.sources[sourceType]
+	if !ok {
+		return nil
+	}
+
+	resources, err := src.ResourcesFor(namespace, name)
+	if err != nil {
+		return err
+	}
+
+	desired := make(map[ownedRecord]dns.RR)
+	for _, res := range resources {
+		records, err := constructRecords(res)
+		if err != nil {
+			log.Printf("Skipping records for %s %s/%s: %v\n", res.SourceType, res.Namespace, res.ObjectName, err)
+		}
+		for _, rr := range records {
+			desired[ownedRecord{rr.String(), owner}] = rr
+		}
+	}
+
+	current := make(map[ownedRecord]dns.RR)
+	for _, rr := range mdns.RecordsFor(owner) {
+		current[ownedRecord{rr.String(), owner}] = rr
+	}
+
+	return apply(desired, current)
+}
+
+// reconcile computes the records desired by every source, compares them with
+// the records in the zone, and applies the difference. Nothing is changed
+// until every source has synced, to avoid withdrawing records which are simply
+// not yet known.
+func (r *reconciler) reconcile() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, src := range r.sources {
+		if !src.HasSynced() {
+			log.Printf("Waiting for %s source to sync before reconciling\n", name)
+			return nil
+		}
+	}
+
+	desired := make(map[ownedRecord]dns.RR)
+	counts := make(map[string]int, len(r.sources))
+	for name, src := range r.sources {
+		counts[name] = 0
+
+		resources, err := src.Resources()
+		if err != nil {
+			return fmt.Errorf("unable to list %s resources: %v", name, err)
+		}
+
+		for _, res := range resources {
+			records, err := constructRecords(res)
+			if err != nil {
+				log.Printf("Skipping records for %s %s/%s: %v\n", res.SourceType, res.Namespace, res.ObjectName, err)
+			}
+
+			owner := res.Owner()
+			for _, rr := range records {
+				key := ownedRecord{rr.String(), owner}
+				if _, ok := desired[key]; !ok {
+					desired[key] = rr
+					counts[name]++
+				}
+			}
+		}
+	}
+	for _, prune := range r.prune {
+		prune()
+	}
+
+	current := make(map[ownedRecord]dns.RR)
+	for _, record := range mdns.Records() {
+		for _, owner := range record.Owners {
+			// Records without an owner are not managed by the reconciler
+			if owner == "" {
+				continue
+			}
+			current[ownedRecord{record.RR.String(), owner}] = record.RR
+		}
+	}
+
+	err := apply(desired, current)
+
+	for name, count := range counts {
+		metrics.PublishedRecords.WithLabelValues(name).Set(float64(count))
+	}
+
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&r.ready, 1)
+	return nil
+}
+
+// ownerSourceType returns the source type component of an owner key
+func ownerSourceType(owner string) string {
+	sourceType, _, _, _ := resource.SplitOwnerKey(owner)
+	return sourceType
+}
+
+// recordSet identifies the records published under a name for a record type
+type recordSet struct {
+	name   string
+	rrtype uint16
+}
+
+// setChange holds the records published to and withdrawn from a record set
+type setChange struct {
+	added   []dns.RR
+	removed []dns.RR
+}
+
+// action returns whether the record set was added, updated, or deleted
+func (c *setChange) action() string {
+	switch {
+	case len(c.removed) == 0:
+		return resource.Added
+	case len(c.added) == 0:
+		return resource.Deleted
+	default:
+		return resource.Updated
+	}
+}
+
+// diffRecords returns the records in desired which are not in current, which
+// are to be published, and the records in current which are not in desired,
+// which are to be withdrawn
+func diffRecords(desired, current map[ownedRecord]dns.RR) (publish, withdraw map[ownedRecord]dns.RR) {
+	publish = make(map[ownedRecord]dns.RR)
+	withdraw = make(map[ownedRecord]dns.RR)
+	for key, rr := range desired {
+		if _, ok := current[key]; !ok {
+			publish[key] = rr
+		}
+	}
+	for key, rr := range current {
+		if _, ok := desired[key]; !ok {
+			withdraw[key] = rr
+		}
+	}
+	return publish, withdraw
+}
+
+// groupChanges groups the records which were published for their first owner,
+// and those which were withdrawn after their last owner, by record set
+func groupChanges(added, removed []dns.RR) map[recordSet]*setChange {
+	changes := make(map[recordSet]*setChange)
+	changeFor := func(rr dns.RR) *setChange {
+		set := recordSet{rr.Header().Name, rr.Header().Rrtype}
+		if changes[set] == nil {
+			changes[set] = &setChange{}
+		}
+		return changes[set]
+	}
+
+	for _, rr := range added {
+		changeFor(rr).added = append(changeFor(rr).added, rr)
+	}
+	for _, rr := range removed {
+		changeFor(rr).removed = append(changeFor(rr).removed, rr)
+	}
+	return changes
+}
+
+// notifications returns the record sets which gained records, which are
+// announced with the cache-flush bit set so that clients atomically replace any
+// stale records they have cached, and the records of sets which were withdrawn
+// entirely, which are sent as goodbye packets
+func notifications(changes map[recordSet]*setChange) (announce []recordSet, goodbye []dns.RR) {
+	for set, change := range changes {
+		if change.action() == resource.Deleted {
+			goodbye = append(goodbye, change.removed...)
+		} else {
+			announce = append(announce, set)
+		}
+	}
+	sort.Slice(announce, func(i, j int) bool {
+		if announce[i].name != announce[j].name {
+			return announce[i].name < announce[j].name
+		}
+		return announce[i].rrtype < announce[j].rrtype
+	})
+	return announce, goodbye
+}
+
+// apply publishes the records in desired which are not in current, and then
+// withdraws the records in current which are not in desired. New records are
+// published first so that a name being updated is never briefly unresolvable.
+// Clients are then notified of the record sets which changed.
+func apply(desired, current map[ownedRecord]dns.RR) error {
+	var errs []error
+	var added, removed []dns.RR
+	publish, withdraw := diffRecords(desired, current)
+
+	for key, rr := range publish {
+		change, err := mdns.PublishRR(rr, key.owner)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if change != mdns.Unchanged {
+			metrics.PublishedRecords.WithLabelValues(ownerSourceType(key.owner)).Inc()
+		}
+		if change == mdns.RecordChanged {
+			added = append(added, rr)
+		}
+	}
+
+	for key, rr := range withdraw {
+		change, err := mdns.UnPublishRR(rr, key.owner)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if change != mdns.Unchanged {
+			metrics.PublishedRecords.WithLabelValues(ownerSourceType(key.owner)).Dec()
+		}
+		if change == mdns.RecordChanged {
+			removed = append(removed, rr)
+		}
+	}
+
+	changes := groupChanges(added, removed)
+	for set, change := range changes {
+		switch change.action() {
+		case resource.Added:
+			for _, rr := range change.added {
+				log.Printf("Added %s\n", rr)
+			}
+		case resource.Deleted:
+			for _, rr := range change.removed {
+				log.Printf("Remove %s\n", rr)
+			}
+		case resource.Updated:
+			log.Printf("Updated %s %s from %v to %v\n", set.name, dns.TypeToString[set.rrtype], rdata(change.removed), rdata(change.added))
+		}
+	}
+
+	announce, goodbye := notifications(changes)
+	for _, set := range announce {
+		if err := mdns.Announce(set.name, set.rrtype); err != nil {
+			log.Printf("Unable to announce %s %s: %v\n", set.name, dns.TypeToString[set.rrtype], err)
+		}
+	}
+	if err := mdns.Goodbye(goodbye...); err != nil {
+		log.Printf("Unable to send goodbyes: %v\n", err)
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// rdata returns the data portion of each record
+func rdata(rrs []dns.RR) []string {
+	data := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		data = append(data, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	return data
+}
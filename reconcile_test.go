@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/miekg/dns"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func records(t *testing.T, owner string, rrs ...string) map[ownedRecord]dns.RR {
+	t.Helper()
+	m := make(map[ownedRecord]dns.RR)
+	for _, s := range rrs {
+		rr := mustRR(t, s)
+		m[ownedRecord{rr.String(), owner}] = rr
+	}
+	return m
+}
+
+func TestDiffRecords(t *testing.T) {
+	const owner = "service/default/nas"
+	desired := records(t, owner, "nas.local. 120 IN A 192.168.1.10", "nas.local. 60 IN AAAA fd00::10")
+	current := records(t, owner, "nas.local. 120 IN A 192.168.1.10", "nas.local. 120 IN AAAA fd00::10")
+
+	publish, withdraw := diffRecords(desired, current)
+	if want := records(t, owner, "nas.local. 60 IN AAAA fd00::10"); !reflect.DeepEqual(publish, want) {
+		t.Errorf("publish = %v, want %v", publish, want)
+	}
+	if want := records(t, owner, "nas.local. 120 IN AAAA fd00::10"); !reflect.DeepEqual(withdraw, want) {
+		t.Errorf("withdraw = %v, want %v", withdraw, want)
+	}
+
+	publish, withdraw = diffRecords(desired, desired)
+	if len(publish) != 0 || len(withdraw) != 0 {
+		t.Errorf("unchanged records were published %v or withdrawn %v", publish, withdraw)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	tests := []struct {
+		name         string
+		added        []string
+		removed      []string
+		action       string
+		wantAnnounce bool
+		wantGoodbye  int
+	}{
+		{
+			name:         "added",
+			added:        []string{"nas.local. 120 IN A 192.168.1.10"},
+			action:       resource.Added,
+			wantAnnounce: true,
+		},
+		{
+			name:         "changed TTL",
+			added:        []string{"nas.local. 60 IN A 192.168.1.10"},
+			removed:      []string{"nas.local. 120 IN A 192.168.1.10"},
+			action:       resource.Updated,
+			wantAnnounce: true,
+		},
+		{
+			name:         "changed rdata",
+			added:        []string{"nas.local. 120 IN A 192.168.1.11"},
+			removed:      []string{"nas.local. 120 IN A 192.168.1.10"},
+			action:       resource.Updated,
+			wantAnnounce: true,
+		},
+		{
+			name:        "withdrawn",
+			removed:     []string{"nas.local. 120 IN A 192.168.1.10", "nas.local. 120 IN A 192.168.1.11"},
+			action:      resource.Deleted,
+			wantGoodbye: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var added, removed []dns.RR
+			for _, s := range tt.added {
+				added = append(added, mustRR(t, s))
+			}
+			for _, s := range tt.removed {
+				removed = append(removed, mustRR(t, s))
+			}
+
+			changes := groupChanges(added, removed)
+			set := recordSet{"nas.local.", dns.TypeA}
+			if len(changes) != 1 || changes[set] == nil {
+				t.Fatalf("changes = %v, want a single change to %v", changes, set)
+			}
+			if action := changes[set].action(); action != tt.action {
+				t.Errorf("action = %s, want %s", action, tt.action)
+			}
+
+			announce, goodbye := notifications(changes)
+			if got := len(announce) == 1 && announce[0] == set; got != tt.wantAnnounce {
+				t.Errorf("announce = %v, want announced %v", announce, tt.wantAnnounce)
+			}
+			if len(goodbye) != tt.wantGoodbye {
+				t.Errorf("goodbye = %v, want %d records", goodbye, tt.wantGoodbye)
+			}
+		})
+	}
+}
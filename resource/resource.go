@@ -14,6 +14,12 @@
 
 package resource
 
+import (
+	"fmt"
+	"strings"
+)
+
+// Actions describing how a set of records has changed
 const (
 	Added   = "ADD"
 	Deleted = "DELETE"
@@ -23,9 +29,38 @@ const (
 // Resource represents a resource to advertise over mDNS
 type Resource struct {
 	SourceType       string
-	Action           string
+	ObjectName       string // Name of the Kubernetes object the resource originates from
 	IPs              []string
+	Targets          []string // Hostnames to publish CNAME records for when there are no IPs
 	Names            []string
 	Namespace        string
-	WithoutNamespace bool // For service annotation override, not global flag
+	WithoutNamespace bool   // For annotation override, not global flag
+	TTL              uint32 // Overrides the global record TTL when non-zero
+}
+
+// Owner returns a key identifying the Kubernetes object the resource
+// originates from, which is used to track which objects publish each record
+func (r Resource) Owner() string {
+	return OwnerKey(r.SourceType, r.Namespace, r.ObjectName)
+}
+
+// HasAddresses reports whether the resource has any IPs or CNAME targets to
+// publish
+func (r Resource) HasAddresses() bool {
+	return len(r.IPs) > 0 || len(r.Targets) > 0
+}
+
+// OwnerKey returns the key identifying a Kubernetes object from the given
+// source. Cluster-scoped objects have an empty namespace.
+func OwnerKey(sourceType, namespace, name string) string {
+	return sourceType + "/" + namespace + "/" + name
+}
+
+// SplitOwnerKey splits a key returned by OwnerKey into its components
+func SplitOwnerKey(key string) (sourceType, namespace, name string, err error) {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 {
+		return "", "", "", fmt.Errorf("unexpected owner key format: %q", key)
+	}
+	return parts[0], parts[1], parts[2], nil
 }
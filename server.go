@@ -0,0 +1,87 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/blake/external-mdns/mdns"
+	"github.com/blake/external-mdns/metrics"
+)
+
+// healthCheckTimeout bounds how long a probe waits on an event loop
+const healthCheckTimeout = 2 * time.Second
+
+// readinessCheck reports whether a component is ready to serve
+type readinessCheck struct {
+	name  string
+	ready func() bool
+}
+
+var (
+	// loopPing is used to verify the main event loop is still reconciling
+	// records
+	loopPing = make(chan chan struct{})
+
+	readinessChecks []readinessCheck
+)
+
+func serveHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	log.Printf("Serving metrics and health checks on %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Unable to serve metrics and health checks on %s: %v", addr, err)
+	}
+}
+
+// healthzHandler reports whether an mDNS socket is able to read and both the
+// mDNS zone and the Kubernetes event loop are responsive
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := mdns.Healthy(healthCheckTimeout); err != nil {
+		http.Error(w, fmt.Sprintf("mdns: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	pong := make(chan struct{})
+	select {
+	case loopPing <- pong:
+		<-pong
+	case <-time.After(healthCheckTimeout):
+		http.Error(w, fmt.Sprintf("event loop did not respond within %s", healthCheckTimeout), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports whether every source has synced its informer cache,
+// and the records for those sources have since been published
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	for _, check := range readinessChecks {
+		if !check.ready() {
+			http.Error(w, fmt.Sprintf("%s: not ready", check.name), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// Annotations which control how an object is published
+const (
+	// EnabledAnnotation opts an object in to publishing when set to "true",
+	// and out of publishing when set to "false"
+	EnabledAnnotation = "external-mdns.blakecovarrubias.com/enabled"
+
+	// HostnamesAnnotation is a comma-separated list of names to publish
+	HostnamesAnnotation = "external-mdns.blakecovarrubias.com/hostnames"
+
+	// WithoutNamespaceAnnotation publishes names without the namespace
+	WithoutNamespaceAnnotation = "external-mdns.blakecovarrubias.com/without-namespace"
+
+	// TTLAnnotation overrides the TTL, in seconds, of the published records
+	TTLAnnotation = "external-mdns.blakecovarrubias.com/ttl"
+
+	// PublishInternalAnnotation publishes the cluster IP of a ClusterIP
+	// Service when set to "true"
+	PublishInternalAnnotation = "external-mdns.blakecovarrubias.com/publish-internal"
+
+	// PublishEndpointsAnnotation publishes the ready endpoints of a headless
+	// Service when set to "true"
+	PublishEndpointsAnnotation = "external-mdns.blakecovarrubias.com/publish-endpoints"
+)
+
+// optedOut reports whether annotations disable publishing for an object
+func optedOut(annotations map[string]string) bool {
+	enabled, ok := annotations[EnabledAnnotation]
+	return ok && strings.EqualFold(enabled, "false")
+}
+
+// annotationTTL returns the TTL set by annotations, or zero if no valid TTL is
+// set. kind, namespace, and name identify the object in the error logged for
+// an invalid TTL.
+func annotationTTL(annotations map[string]string, kind, namespace, name string) uint32 {
+	value, ok := annotations[TTLAnnotation]
+	if !ok {
+		return 0
+	}
+
+	ttl, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("ignoring invalid %s annotation on %s %s/%s: %v", TTLAnnotation, kind, namespace, name, err))
+		return 0
+	}
+	return uint32(ttl)
+}
+
+// annotationHostnames returns the names listed in the hostnames annotation,
+// and whether the annotation is set
+func annotationHostnames(annotations map[string]string) ([]string, bool) {
+	hostnames, ok := annotations[HostnamesAnnotation]
+	if !ok {
+		return nil, false
+	}
+
+	var names []string
+	for _, name := range strings.Split(hostnames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, true
+}
+
+// annotationWithoutNamespace returns the value of the without-namespace
+// annotation, or defaultVal if it is not set
+func annotationWithoutNamespace(annotations map[string]string, defaultVal bool) bool {
+	withoutNS, ok := annotations[WithoutNamespaceAnnotation]
+	if !ok {
+		return defaultVal
+	}
+	return strings.EqualFold(withoutNS, "true")
+}
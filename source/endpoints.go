@@ -0,0 +1,146 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blake/external-mdns/metrics"
+	"github.com/blake/external-mdns/resource"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// serviceIndex indexes EndpointSlices by the namespace and name of the Service
+// they belong to
+const serviceIndex = "service"
+
+// indexByService returns the key of the Service an EndpointSlice belongs to
+func indexByService(obj interface{}) ([]string, error) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+	serviceName, ok := slice.Labels[discoveryv1.LabelServiceName]
+	if !ok {
+		return nil, nil
+	}
+	return []string{storeKey(slice.Namespace, serviceName)}, nil
+}
+
+// publishEndpoints reports whether the endpoints of service are published in
+// place of its cluster IP
+func (s *ServiceSource) publishEndpoints(service *corev1.Service) bool {
+	return s.opts.PublishHeadless &&
+		service.Spec.ClusterIP == corev1.ClusterIPNone &&
+		strings.EqualFold(service.Annotations[PublishEndpointsAnnotation], "true")
+}
+
+// hasReadyEndpoint reports whether any endpoint of service is ready
+func (s *ServiceSource) hasReadyEndpoint(service *corev1.Service) (bool, error) {
+	slices, err := s.endpoints.ByIndex(serviceIndex, storeKey(service.Namespace, service.Name))
+	if err != nil {
+		return false, err
+	}
+
+	for _, obj := range slices {
+		slice, ok := obj.(*discoveryv1.EndpointSlice)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpointReady(endpoint) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// endpointReady reports whether endpoint is ready. A nil ready condition is
+// unknown, and should be interpreted as ready.
+func endpointReady(endpoint discoveryv1.Endpoint) bool {
+	return endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+}
+
+// endpointResources returns the resources to advertise for the ready
+// endpoints of a headless Service. The addresses of every endpoint are added
+// to the aggregate resource for the Service, and each endpoint with a hostname,
+// or which is a Pod, is also published under that name.
+func (s *ServiceSource) endpointResources(service *corev1.Service, aggregate resource.Resource) ([]resource.Resource, error) {
+	slices, err := s.endpoints.ByIndex(serviceIndex, storeKey(service.Namespace, service.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	addresses := make(map[string][]string)
+	for _, obj := range slices {
+		slice, ok := obj.(*discoveryv1.EndpointSlice)
+		if !ok || slice.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			if !endpointReady(endpoint) {
+				continue
+			}
+			aggregate.IPs = append(aggregate.IPs, endpoint.Addresses...)
+
+			var name string
+			switch {
+			case endpoint.Hostname != nil && *endpoint.Hostname != "":
+				name = *endpoint.Hostname
+			case endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod":
+				name = endpoint.TargetRef.Name
+			default:
+				continue
+			}
+			if _, ok := addresses[name]; !ok {
+				names = append(names, name)
+			}
+			addresses[name] = append(addresses[name], endpoint.Addresses...)
+		}
+	}
+
+	resources := []resource.Resource{aggregate}
+	for _, name := range names {
+		endpointResource := aggregate
+		endpointResource.Names = []string{name}
+		endpointResource.IPs = addresses[name]
+		resources = append(resources, endpointResource)
+	}
+	return resources, nil
+}
+
+// onEndpointSliceChange queues the Service an EndpointSlice belongs to
+func (s *ServiceSource) onEndpointSliceChange(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+	serviceName, ok := slice.Labels[discoveryv1.LabelServiceName]
+	if !ok {
+		return
+	}
+
+	metrics.KubernetesEvents.WithLabelValues("service", "endpointslice").Inc()
+	s.queue.Add(resource.OwnerKey("service", slice.Namespace, serviceName))
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ObjectFilter decides which objects are published based on their labels and
+// annotations
+type ObjectFilter struct {
+	labels      labels.Selector
+	annotations labels.Selector
+	optIn       bool
+}
+
+// Matches reports whether the records for obj may be published
+func (f *ObjectFilter) Matches(obj interface{}) bool {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+
+	if f.optIn && !strings.EqualFold(accessor.GetAnnotations()[EnabledAnnotation], "true") {
+		return false
+	}
+	if f.labels != nil && !f.labels.Matches(labels.Set(accessor.GetLabels())) {
+		return false
+	}
+	if f.annotations != nil && !f.annotations.Matches(labels.Set(accessor.GetAnnotations())) {
+		return false
+	}
+	return true
+}
+
+// NewObjectFilter creates an ObjectFilter from label selectors for labels and
+// annotations, which are ignored if empty.
+func NewObjectFilter(labelFilter, annotationFilter string, optIn bool) (*ObjectFilter, error) {
+	f := &ObjectFilter{optIn: optIn}
+
+	var err error
+	if labelFilter != "" {
+		if f.labels, err = labels.Parse(labelFilter); err != nil {
+			return nil, fmt.Errorf("invalid label filter %q: %v", labelFilter, err)
+		}
+	}
+	if annotationFilter != "" {
+		if f.annotations, err = labels.Parse(annotationFilter); err != nil {
+			return nil, fmt.Errorf("invalid annotation filter %q: %v", annotationFilter, err)
+		}
+	}
+
+	return f, nil
+}
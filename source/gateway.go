@@ -0,0 +1,439 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/blake/external-mdns/metrics"
+	"github.com/blake/external-mdns/resource"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// gatewayGroup is the API group of the Gateway API
+const gatewayGroup = "gateway.networking.k8s.io"
+
+// gatewayResources lists the Gateway API resources which are watched, and the
+// versions of each which are supported in order of preference
+var gatewayResources = map[string][]string{
+	"gateways":   {"v1", "v1beta1"},
+	"httproutes": {"v1", "v1beta1"},
+	"grpcroutes": {"v1", "v1alpha2"},
+	"tlsroutes":  {"v1alpha3", "v1alpha2"},
+}
+
+// GatewaySource provides the mDNS record advertisements for Gateway API
+// routes. Each hostname of a route is published with the addresses of the
+// Gateways it is attached to.
+//
+// Routes of every kind are owned by this source, so the name of each route
+// object is prefixed with its resource, for example httproutes/web.
+type GatewaySource struct {
+	domain       string
+	remapDomains []string
+	queue        workqueue.Interface
+	gateways     informerSet
+	routes       map[string]informerSet // keyed by resource, e.g. httproutes
+	namespaces   *NamespaceFilter
+	filter       *ObjectFilter
+	hostnames    *HostnameResolver
+}
+
+// Run starts the informers for each watched namespace and waits for their
+// caches to synchronize.
+func (g *GatewaySource) Run(stopCh chan struct{}) error {
+	g.gateways.Run(stopCh)
+	for _, informers := range g.routes {
+		informers.Run(stopCh)
+	}
+	if !cache.WaitForCacheSync(stopCh, g.HasSynced) {
+		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
+		return nil
+	}
+	metrics.InformerSynced.WithLabelValues("gateway").Set(1)
+
+	<-stopCh
+	return nil
+}
+
+// HasSynced reports whether the informer caches have synced
+func (g *GatewaySource) HasSynced() bool {
+	for _, informers := range g.routes {
+		if !informers.HasSynced() {
+			return false
+		}
+	}
+	return g.gateways.HasSynced() && g.namespaces.HasSynced()
+}
+
+// Resources returns the resources to advertise for every route in the
+// informer caches
+func (g *GatewaySource) Resources() ([]resource.Resource, error) {
+	var resources []resource.Resource
+	for kind, informers := range g.routes {
+		for _, obj := range informers.List() {
+			resources = append(resources, g.buildRecords(kind, obj)...)
+		}
+	}
+	return resources, nil
+}
+
+// ResourcesFor returns the resources to advertise for a single route. name is
+// prefixed with the resource of the route, for example httproutes/web.
+func (g *GatewaySource) ResourcesFor(namespace, name string) ([]resource.Resource, error) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("unexpected route name format: %q", name)
+	}
+	informers, ok := g.routes[parts[0]]
+	if !ok {
+		return nil, nil
+	}
+
+	obj, exists, err := informers.GetByKey(namespace, parts[1])
+	if err != nil || !exists {
+		return nil, err
+	}
+	return g.buildRecords(parts[0], obj), nil
+}
+
+// enqueueRoute queues a route of the given kind
+func (g *GatewaySource) enqueueRoute(kind string, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	route, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	g.queue.Add(resource.OwnerKey("gateway", route.GetNamespace(), kind+"/"+route.GetName()))
+}
+
+// enqueueAll queues every route. It is called when a Gateway changes, which
+// may affect any route attached to it.
+func (g *GatewaySource) enqueueAll() {
+	for kind, informers := range g.routes {
+		for _, obj := range informers.List() {
+			g.enqueueRoute(kind, obj)
+		}
+	}
+}
+
+// onNamespaceChange queues every route in a namespace which became allowed or
+// disallowed
+func (g *GatewaySource) onNamespaceChange(namespace string) {
+	for kind, informers := range g.routes {
+		for _, obj := range informers.ListNamespace(namespace) {
+			g.enqueueRoute(kind, obj)
+		}
+	}
+}
+
+// routeHandler returns the event handler for routes of the given kind
+func (g *GatewaySource) routeHandler(kind string) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			metrics.KubernetesEvents.WithLabelValues("gateway", "add").Inc()
+			g.enqueueRoute(kind, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			metrics.KubernetesEvents.WithLabelValues("gateway", "delete").Inc()
+			g.enqueueRoute(kind, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			metrics.KubernetesEvents.WithLabelValues("gateway", "update").Inc()
+			g.enqueueRoute(kind, newObj)
+		},
+	}
+}
+
+// parentRef identifies a Gateway, and optionally one of its listeners
+type parentRef struct {
+	namespace   string
+	name        string
+	sectionName string
+}
+
+// attachedParents returns the Gateways a route has been accepted by, as
+// reported in its status
+func attachedParents(route *unstructured.Unstructured) []parentRef {
+	parents, _, _ := unstructured.NestedSlice(route.Object, "status", "parents")
+
+	var refs []parentRef
+	for _, p := range parents {
+		parent, ok := p.(map[string]interface{})
+		if !ok || !conditionTrue(parent, "Accepted") {
+			continue
+		}
+
+		group, found, _ := unstructured.NestedString(parent, "parentRef", "group")
+		if found && group != gatewayGroup {
+			continue
+		}
+		kind, found, _ := unstructured.NestedString(parent, "parentRef", "kind")
+		if found && kind != "Gateway" {
+			continue
+		}
+
+		ref := parentRef{namespace: route.GetNamespace()}
+		ref.name, _, _ = unstructured.NestedString(parent, "parentRef", "name")
+		ref.sectionName, _, _ = unstructured.NestedString(parent, "parentRef", "sectionName")
+		if namespace, found, _ := unstructured.NestedString(parent, "parentRef", "namespace"); found && namespace != "" {
+			ref.namespace = namespace
+		}
+		if ref.name != "" {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// conditionTrue reports whether the condition of the given type in the
+// conditions of obj has a status of True
+func conditionTrue(obj map[string]interface{}, conditionType string) bool {
+	conditions, _, _ := unstructured.NestedSlice(obj, "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != conditionType {
+			continue
+		}
+		return condition["status"] == "True"
+	}
+	return false
+}
+
+// gatewayTargets returns the addresses, and the CNAME targets, to publish for
+// a Gateway
+func (g *GatewaySource) gatewayTargets(gateway *unstructured.Unstructured) ([]string, []string) {
+	addresses, _, _ := unstructured.NestedSlice(gateway.Object, "status", "addresses")
+
+	var status corev1.LoadBalancerStatus
+	for _, a := range addresses {
+		address, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		value, _ := address["value"].(string)
+		switch addressType, _ := address["type"].(string); addressType {
+		case "", "IPAddress":
+			status.Ingress = append(status.Ingress, corev1.LoadBalancerIngress{IP: value})
+		case "Hostname":
+			status.Ingress = append(status.Ingress, corev1.LoadBalancerIngress{Hostname: value})
+		}
+	}
+	return g.hostnames.Targets(status)
+}
+
+// listenerHostnames returns the hostname of each listener of a Gateway, or
+// only of the named listener if sectionName is set. Listeners without a
+// hostname, which accept any hostname, are returned as an empty string.
+func listenerHostnames(gateway *unstructured.Unstructured, sectionName string) []string {
+	listeners, _, _ := unstructured.NestedSlice(gateway.Object, "spec", "listeners")
+
+	var hostnames []string
+	for _, l := range listeners {
+		listener, ok := l.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, _ := listener["name"].(string); sectionName != "" && name != sectionName {
+			continue
+		}
+		hostname, _ := listener["hostname"].(string)
+		hostnames = append(hostnames, strings.ToLower(hostname))
+	}
+	return hostnames
+}
+
+// routeHostnames returns the hostnames served for a route by the given
+// listeners. Routes without hostnames are served under the hostname of each
+// listener. Otherwise, only route hostnames which intersect with a listener
+// hostname are served, as described by the Gateway API.
+func routeHostnames(hostnames, listeners []string) []string {
+	var served []string
+	seen := make(map[string]struct{})
+	add := func(hostname string) {
+		if _, ok := seen[hostname]; !ok && hostname != "" {
+			seen[hostname] = struct{}{}
+			served = append(served, hostname)
+		}
+	}
+
+	for _, listener := range listeners {
+		if len(hostnames) == 0 {
+			add(listener)
+			continue
+		}
+		for _, hostname := range hostnames {
+			if intersection, ok := intersectHostnames(listener, strings.ToLower(hostname)); ok {
+				add(intersection)
+			}
+		}
+	}
+	return served
+}
+
+// intersectHostnames returns the most specific hostname matched by both a
+// listener hostname and a route hostname, either of which may be a wildcard.
+// An empty listener hostname matches any route hostname.
+func intersectHostnames(listener, route string) (string, bool) {
+	switch {
+	case listener == "" || listener == route:
+		return route, true
+	case strings.HasPrefix(listener, "*.") && strings.HasSuffix(route, listener[1:]):
+		return route, true
+	case strings.HasPrefix(route, "*.") && strings.HasSuffix(listener, route[1:]):
+		return listener, true
+	}
+	return "", false
+}
+
+// buildRecords returns a resource for each Gateway a route is attached to.
+// The hostnames the Gateway's listeners serve for the route within a published
+// domain are published with the addresses of the Gateway. Wildcard hostnames
+// are skipped.
+func (g *GatewaySource) buildRecords(kind string, obj interface{}) []resource.Resource {
+	var records []resource.Resource
+
+	route, ok := obj.(*unstructured.Unstructured)
+	if !ok || optedOut(route.GetAnnotations()) || !g.namespaces.Allowed(route.GetNamespace()) || !g.filter.Matches(route) {
+		return records
+	}
+	hostnames, _, _ := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+
+	for _, parent := range attachedParents(route) {
+		obj, exists, err := g.gateways.GetByKey(parent.namespace, parent.name)
+		if err != nil || !exists {
+			continue
+		}
+		gateway, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+
+		ips, cnames := g.gatewayTargets(gateway)
+		if len(ips) == 0 && len(cnames) == 0 {
+			continue
+		}
+
+		var names []string
+		for _, host := range routeHostnames(hostnames, listenerHostnames(gateway, parent.sectionName)) {
+			if strings.HasPrefix(host, "*") {
+				continue
+			}
+			if name, ok := trimDomain(host, g.domain, g.remapDomains); ok {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+
+		records = append(records, resource.Resource{
+			SourceType: "gateway",
+			ObjectName: kind + "/" + route.GetName(),
+			Names:      names,
+			Namespace:  route.GetNamespace(),
+			IPs:        ips,
+			Targets:    cnames,
+			// Route hostnames are published without the namespace unless the
+			// annotation says otherwise, as with Ingress hosts
+			WithoutNamespace: annotationWithoutNamespace(route.GetAnnotations(), true),
+			TTL:              annotationTTL(route.GetAnnotations(), kind, route.GetNamespace(), route.GetName()),
+		})
+	}
+	return records
+}
+
+// servedVersion returns the preferred version of a Gateway API resource
+// served by the cluster, or false if none is
+func servedVersion(client discovery.DiscoveryInterface, resourceName string) (string, bool) {
+	for _, version := range gatewayResources[resourceName] {
+		list, err := client.ServerResourcesForGroupVersion(gatewayGroup + "/" + version)
+		if err != nil {
+			continue
+		}
+		for _, r := range list.APIResources {
+			if r.Name == resourceName {
+				return version, true
+			}
+		}
+	}
+	return "", false
+}
+
+// newDynamicInformerSet obtains an informer for gvr from each factory.
+// factories is keyed by the namespace each factory is scoped to.
+func newDynamicInformerSet(factories map[string]dynamicinformer.DynamicSharedInformerFactory, gvr schema.GroupVersionResource) informerSet {
+	set := make(informerSet, len(factories))
+	for namespace, factory := range factories {
+		set[namespace] = factory.ForResource(gvr).Informer()
+	}
+	return set
+}
+
+// NewGatewayWatcher creates a GatewaySource, watching the route kinds the
+// cluster serves using factories, keyed by the namespace each is scoped to.
+func NewGatewayWatcher(factories map[string]dynamicinformer.DynamicSharedInformerFactory, client discovery.DiscoveryInterface, namespaces *NamespaceFilter, filter *ObjectFilter, hostnames *HostnameResolver, domain string, remapDomains []string, queue workqueue.Interface) (*GatewaySource, error) {
+	metrics.InformerSynced.WithLabelValues("gateway").Set(0)
+
+	version, ok := servedVersion(client, "gateways")
+	if !ok {
+		return nil, fmt.Errorf("the cluster does not serve Gateways in the %s API group", gatewayGroup)
+	}
+
+	g := &GatewaySource{
+		domain:       domain,
+		remapDomains: remapDomains,
+		queue:        queue,
+		gateways:     newDynamicInformerSet(factories, schema.GroupVersionResource{Group: gatewayGroup, Version: version, Resource: "gateways"}),
+		routes:       make(map[string]informerSet),
+		namespaces:   namespaces,
+		filter:       filter,
+		hostnames:    hostnames,
+	}
+
+	for resourceName := range gatewayResources {
+		if resourceName == "gateways" {
+			continue
+		}
+		version, ok := servedVersion(client, resourceName)
+		if !ok {
+			log.Printf("Skipping %s, which the cluster does not serve\n", resourceName)
+			continue
+		}
+		g.routes[resourceName] = newDynamicInformerSet(factories, schema.GroupVersionResource{Group: gatewayGroup, Version: version, Resource: resourceName})
+		g.routes[resourceName].AddEventHandler(g.routeHandler(resourceName))
+	}
+
+	g.namespaces.AddHandler(g.onNamespaceChange)
+	g.hostnames.AddHandler(g.enqueueAll)
+	g.gateways.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { g.enqueueAll() },
+		DeleteFunc: func(interface{}) { g.enqueueAll() },
+		UpdateFunc: func(interface{}, interface{}) { g.enqueueAll() },
+	})
+
+	return g, nil
+}
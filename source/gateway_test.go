@@ -0,0 +1,32 @@
+package source
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRouteHostnames(t *testing.T) {
+	tests := []struct {
+		name      string
+		hostnames []string
+		listeners []string
+		want      []string
+	}{
+		{"listener without hostname", []string{"app.local"}, []string{""}, []string{"app.local"}},
+		{"route without hostnames", nil, []string{"app.local", ""}, []string{"app.local"}},
+		{"exact match", []string{"app.local", "other.local"}, []string{"app.local"}, []string{"app.local"}},
+		{"no match", []string{"other.local"}, []string{"app.local"}, nil},
+		{"wildcard listener", []string{"app.local", "app.example.com"}, []string{"*.local"}, []string{"app.local"}},
+		{"wildcard route", []string{"*.local"}, []string{"app.local"}, []string{"app.local"}},
+		{"wildcard listener does not match its own domain", []string{"local"}, []string{"*.local"}, nil},
+		{"case", []string{"App.Local"}, []string{"app.local"}, []string{"app.local"}},
+		{"duplicates", []string{"app.local"}, []string{"app.local", "*.local"}, []string{"app.local"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := routeHostnames(tt.hostnames, tt.listeners); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("routeHostnames(%v, %v) = %v, want %v", tt.hostnames, tt.listeners, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// lookupTimeout bounds how long a single hostname lookup may take
+const lookupTimeout = 5 * time.Second
+
+// HostnameMode controls how load balancer entries which only have a hostname
+// are published
+type HostnameMode string
+
+// Supported hostname modes
+const (
+	HostnameIgnore  HostnameMode = "ignore"  // Skip the entry
+	HostnameResolve HostnameMode = "resolve" // Publish the addresses the hostname resolves to
+	HostnameCNAME   HostnameMode = "cname"   // Publish a CNAME record targeting the hostname
+)
+
+// ParseHostnameMode returns the HostnameMode named by s
+func ParseHostnameMode(s string) (HostnameMode, error) {
+	switch mode := HostnameMode(s); mode {
+	case HostnameIgnore, HostnameResolve, HostnameCNAME:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported load balancer hostname mode %q, must be one of %s, %s, or %s", s, HostnameIgnore, HostnameResolve, HostnameCNAME)
+	}
+}
+
+// Resolver looks up the addresses of a hostname. It is implemented by
+// *net.Resolver.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// HostnameResolver translates the hostnames of load balancer entries into the
+// addresses or CNAME targets to publish. Resolved addresses are cached, and
+// refreshed periodically so that records follow changes to them.
+type HostnameResolver struct {
+	mode     HostnameMode
+	resolver Resolver
+	interval time.Duration
+	mu       sync.Mutex
+	addrs    map[string][]string // addresses of each hostname, nil until resolved
+	used     map[string]struct{} // hostnames looked up since the last Prune
+	pending  chan string         // hostnames to resolve before the next refresh
+	notifier
+}
+
+// Run resolves newly seen hostnames, and refreshes the addresses of every
+// known hostname each interval, until stopCh is closed
+func (h *HostnameResolver) Run(stopCh <-chan struct{}) {
+	if h.mode != HostnameResolve {
+		return
+	}
+
+	refresh := time.NewTicker(h.interval)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case host := <-h.pending:
+			if h.resolve(host) {
+				h.notify()
+			}
+		case <-refresh.C:
+			h.mu.Lock()
+			hosts := make([]string, 0, len(h.addrs))
+			for host := range h.addrs {
+				hosts = append(hosts, host)
+			}
+			h.mu.Unlock()
+
+			changed := false
+			for _, host := range hosts {
+				changed = h.resolve(host) || changed
+			}
+			if changed {
+				h.notify()
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// resolve looks up the addresses of host, and reports whether they changed.
+// Previously resolved addresses are kept if the lookup fails.
+func (h *HostnameResolver) resolve(host string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	addrs, err := h.resolver.LookupHost(ctx, host)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("unable to resolve load balancer hostname %s: %v", host, err))
+		return false
+	}
+	sort.Strings(addrs)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if current, ok := h.addrs[host]; !ok || reflect.DeepEqual(current, addrs) {
+		// Unchanged, or pruned while being resolved
+		return false
+	}
+	h.addrs[host] = addrs
+	return true
+}
+
+// lookup returns the cached addresses of host. Hostnames which have not been
+// seen before are queued for resolution, and have no addresses until then.
+func (h *HostnameResolver) lookup(host string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.used[host] = struct{}{}
+	addrs, ok := h.addrs[host]
+	if !ok {
+		h.addrs[host] = nil
+		select {
+		case h.pending <- host:
+		default:
+			// Resolved on the next refresh instead
+		}
+	}
+	return append([]string(nil), addrs...)
+}
+
+// Prune forgets the hostnames which have not been looked up since the last
+// call, so that hostnames no longer referenced by any object stop being
+// refreshed. It should be called after the targets of every object are built.
+func (h *HostnameResolver) Prune() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for host := range h.addrs {
+		if _, ok := h.used[host]; !ok {
+			delete(h.addrs, host)
+		}
+	}
+	h.used = make(map[string]struct{})
+}
+
+// Targets returns the addresses, and the CNAME targets, to publish for the
+// entries of a load balancer
+func (h *HostnameResolver) Targets(status corev1.LoadBalancerStatus) (ips []string, cnames []string) {
+	for _, lb := range status.Ingress {
+		switch {
+		case lb.IP != "":
+			ips = append(ips, lb.IP)
+		case lb.Hostname == "":
+		case h.mode == HostnameResolve:
+			ips = append(ips, h.lookup(lb.Hostname)...)
+		case h.mode == HostnameCNAME:
+			cnames = append(cnames, lb.Hostname)
+		}
+	}
+	return ips, cnames
+}
+
+// NewHostnameResolver creates a HostnameResolver which publishes hostnames
+// according to mode, refreshing resolved addresses every interval.
+func NewHostnameResolver(mode HostnameMode, resolver Resolver, interval time.Duration) *HostnameResolver {
+	return &HostnameResolver{
+		mode:     mode,
+		resolver: resolver,
+		interval: interval,
+		addrs:    make(map[string][]string),
+		used:     make(map[string]struct{}),
+		pending:  make(chan string, 64),
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// informerSet holds the informers for one type of object, keyed by the
+// namespace each informer watches. An informer watching all namespaces is
+// keyed by metav1.NamespaceAll.
+type informerSet map[string]cache.SharedIndexInformer
+
+// newInformerSet obtains an informer from each factory using informerFor.
+// factories is keyed by the namespace each factory is scoped to.
+func newInformerSet(factories map[string]informers.SharedInformerFactory, informerFor func(informers.SharedInformerFactory) cache.SharedIndexInformer) informerSet {
+	set := make(informerSet, len(factories))
+	for namespace, factory := range factories {
+		set[namespace] = informerFor(factory)
+	}
+	return set
+}
+
+// AddEventHandler adds handler to every informer in the set
+func (s informerSet) AddEventHandler(handler cache.ResourceEventHandler) {
+	for _, informer := range s {
+		informer.AddEventHandler(handler)
+	}
+}
+
+// Run starts every informer in the set
+func (s informerSet) Run(stopCh <-chan struct{}) {
+	for _, informer := range s {
+		go informer.Run(stopCh)
+	}
+}
+
+// HasSynced reports whether every informer in the set has synced
+func (s informerSet) HasSynced() bool {
+	for _, informer := range s {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// List returns every object in the set's caches
+func (s informerSet) List() []interface{} {
+	var objs []interface{}
+	for _, informer := range s {
+		objs = append(objs, informer.GetStore().List()...)
+	}
+	return objs
+}
+
+// GetByKey returns the object with the given namespace and name from the
+// informer watching that namespace
+func (s informerSet) GetByKey(namespace, name string) (interface{}, bool, error) {
+	informer, ok := s[namespace]
+	if !ok {
+		informer, ok = s[metav1.NamespaceAll]
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	return informer.GetStore().GetByKey(storeKey(namespace, name))
+}
+
+// ListNamespace returns every object in namespace from the set's caches
+func (s informerSet) ListNamespace(namespace string) []interface{} {
+	var objs []interface{}
+	for _, informer := range s {
+		namespaced, err := informer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+		if err != nil {
+			runtime.HandleError(err)
+			continue
+		}
+		objs = append(objs, namespaced...)
+	}
+	return objs
+}
+
+// AddIndexers adds indexers to every informer in the set. Indexers must be
+// added before Run.
+func (s informerSet) AddIndexers(indexers cache.Indexers) error {
+	for _, informer := range s {
+		if err := informer.AddIndexers(indexers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ByIndex returns every object in the set's caches whose indexed value
+// matches key
+func (s informerSet) ByIndex(indexName, key string) ([]interface{}, error) {
+	var objs []interface{}
+	for _, informer := range s {
+		indexed, err := informer.GetIndexer().ByIndex(indexName, key)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, indexed...)
+	}
+	return objs, nil
+}
@@ -16,149 +16,203 @@ package source
 
 import (
 	"fmt"
-	"log"
-	"strings"
 
+	"github.com/blake/external-mdns/metrics"
 	"github.com/blake/external-mdns/resource"
-	"github.com/jpillora/go-tld"
 	v1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
-// IngressSource handles adding, updating, or removing mDNS record advertisements
+// IngressSource provides the mDNS record advertisements for Ingresses
 type IngressSource struct {
-	namespace      string
-	notifyChan     chan<- resource.Resource
-	sharedInformer cache.SharedIndexInformer
+	domain       string
+	remapDomains []string
+	queue        workqueue.Interface
+	informers    informerSet
+	namespaces   *NamespaceFilter
+	filter       *ObjectFilter
+	classes      *IngressClassFilter
+	publishSvc   *PublishService
+	hostnames    *HostnameResolver
 }
 
-// Run starts shared informers and waits for the shared informer cache to
-// synchronize.
+// Run starts the informer for each watched namespace and waits for their
+// caches to synchronize.
 func (i *IngressSource) Run(stopCh chan struct{}) error {
-	i.sharedInformer.Run(stopCh)
-	if !cache.WaitForCacheSync(stopCh, i.sharedInformer.HasSynced) {
+	i.informers.Run(stopCh)
+	i.publishSvc.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, i.HasSynced) {
 		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
+		return nil
 	}
+	metrics.InformerSynced.WithLabelValues("ingress").Set(1)
+
+	<-stopCh
 	return nil
 }
 
-func (i *IngressSource) onAdd(obj interface{}) {
-	advertiseRecords, err := i.buildRecords(obj, resource.Added)
-
-	if err != nil {
-		fmt.Println("Error adding ingress")
-		return
-	}
+// HasSynced reports whether the informer caches have synced
+func (i *IngressSource) HasSynced() bool {
+	return i.informers.HasSynced() && i.namespaces.HasSynced() && i.classes.HasSynced() && i.publishSvc.HasSynced()
+}
 
-	for _, record := range advertiseRecords {
-		i.notifyChan <- record
+// Resources returns the resources to advertise for every Ingress in the
+// informer caches
+func (i *IngressSource) Resources() ([]resource.Resource, error) {
+	var resources []resource.Resource
+	for _, obj := range i.informers.List() {
+		if !i.namespaces.Allowed(objectNamespace(obj)) || !i.filter.Matches(obj) {
+			continue
+		}
+		records, err := i.buildRecords(obj)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, records...)
 	}
+	return resources, nil
 }
 
-func (i *IngressSource) onDelete(obj interface{}) {
-	advertiseRecords, err := i.buildRecords(obj, resource.Deleted)
-
-	if err != nil {
-		fmt.Println("Error deleting ingress")
-		return
+// ResourcesFor returns the resources to advertise for a single Ingress
+func (i *IngressSource) ResourcesFor(namespace, name string) ([]resource.Resource, error) {
+	if !i.namespaces.Allowed(namespace) {
+		return nil, nil
 	}
 
-	for _, record := range advertiseRecords {
-		i.notifyChan <- record
+	obj, exists, err := i.informers.GetByKey(namespace, name)
+	if err != nil || !exists {
+		return nil, err
+	}
+	if !i.filter.Matches(obj) {
+		return nil, nil
 	}
+	return i.buildRecords(obj)
 }
 
-func (i *IngressSource) onUpdate(oldObj interface{}, newObj interface{}) {
-	oldResources, err1 := i.buildRecords(oldObj, resource.Updated)
-	if err1 != nil {
-		fmt.Printf("Error gathering old ingress resources: %s", err1)
+// onNamespaceChange queues every Ingress in a namespace which became allowed or
+// disallowed
+func (i *IngressSource) onNamespaceChange(namespace string) {
+	for _, obj := range i.informers.ListNamespace(namespace) {
+		enqueue(i.queue, "ingress", obj)
 	}
+}
 
-	for _, record := range oldResources {
-		record.Action = resource.Deleted
-		i.notifyChan <- record
+// enqueueAll queues every Ingress. It is called when an IngressClass, the
+// addresses of the publish Service, or the addresses of a load balancer
+// hostname change, any of which may affect any Ingress.
+func (i *IngressSource) enqueueAll() {
+	for _, obj := range i.informers.List() {
+		enqueue(i.queue, "ingress", obj)
 	}
+}
 
-	newResources, err2 := i.buildRecords(newObj, resource.Updated)
-	if err2 != nil {
-		fmt.Printf("Error gathering new ingress resources: %s", err2)
-	}
+func (i *IngressSource) onAdd(obj interface{}) {
+	metrics.KubernetesEvents.WithLabelValues("ingress", "add").Inc()
+	enqueue(i.queue, "ingress", obj)
+}
 
-	for _, record := range newResources {
-		record.Action = resource.Added
-		i.notifyChan <- record
-	}
+func (i *IngressSource) onDelete(obj interface{}) {
+	metrics.KubernetesEvents.WithLabelValues("ingress", "delete").Inc()
+	enqueue(i.queue, "ingress", obj)
+}
+
+func (i *IngressSource) onUpdate(oldObj interface{}, newObj interface{}) {
+	metrics.KubernetesEvents.WithLabelValues("ingress", "update").Inc()
+	enqueue(i.queue, "ingress", newObj)
 }
 
-func (i *IngressSource) buildRecords(obj interface{}, action string) ([]resource.Resource, error) {
+func (i *IngressSource) buildRecords(obj interface{}) ([]resource.Resource, error) {
 	var records []resource.Resource
 
 	ingress, ok := obj.(*v1.Ingress)
-	if !ok {
+	if !ok || optedOut(ingress.Annotations) || !i.classes.Matches(ingress) {
 		return records, nil
 	}
 
-	var ipFields []string
-	for _, lb := range ingress.Status.LoadBalancer.Ingress {
-		if lb.IP != "" {
-			ipFields = append(ipFields, lb.IP)
-		}
+	var ipFields, cnames []string
+	if i.publishSvc.Enabled() {
+		ipFields, cnames = i.publishSvc.Targets()
+	} else {
+		ipFields, cnames = i.hostnames.Targets(ingress.Status.LoadBalancer)
 	}
 
-	if len(ipFields) == 0 {
+	if len(ipFields) == 0 && len(cnames) == 0 {
 		return records, nil
 	}
 
-	// Advertise each hostname under this Ingress
-	var hostname string
+	// Advertise each hostname under this Ingress, followed by any names
+	// listed in the hostnames annotation
+	var names []string
+	seen := make(map[string]struct{})
 	for _, rule := range ingress.Spec.Rules {
-		// Skip rules with no hostname or that do not use the .local TLD
-		if rule.Host == "" || !strings.HasSuffix(rule.Host, ".local") {
-			continue
-		}
-
-		fakeURL := fmt.Sprintf("http://%s", rule.Host)
-		parsedHost, err := tld.Parse(fakeURL)
-
-		if err != nil {
-			log.Printf("Unable to parse hostname %s. %s", rule.Host, err.Error())
+		// Skip rules with no hostname or that are not within a published domain
+		hostname, ok := trimDomain(rule.Host, i.domain, i.remapDomains)
+		if !ok {
 			continue
 		}
-
-		if parsedHost.Subdomain != "" {
-			hostname = fmt.Sprintf("%s.%s", parsedHost.Subdomain, parsedHost.Domain)
-		} else {
-			hostname = parsedHost.Domain
+		if _, ok := seen[hostname]; !ok {
+			seen[hostname] = struct{}{}
+			names = append(names, hostname)
 		}
-		advertiseObj := resource.Resource{
-			SourceType: "ingress",
-			Action:     action,
-			Names:      []string{hostname},
-			Namespace:  ingress.Namespace,
-			IPs:        ipFields,
+	}
+	annotated, _ := annotationHostnames(ingress.Annotations)
+	for _, hostname := range annotated {
+		if _, ok := seen[hostname]; !ok {
+			seen[hostname] = struct{}{}
+			names = append(names, hostname)
 		}
+	}
 
-		records = append(records, advertiseObj)
+	if len(names) == 0 {
+		return records, nil
 	}
+
+	records = append(records, resource.Resource{
+		SourceType: "ingress",
+		ObjectName: ingress.Name,
+		Names:      names,
+		Namespace:  ingress.Namespace,
+		IPs:        ipFields,
+		Targets:    cnames,
+		// Ingress hosts are published without the namespace unless the
+		// annotation says otherwise
+		WithoutNamespace: annotationWithoutNamespace(ingress.Annotations, true),
+		TTL:              annotationTTL(ingress.Annotations, "ingress", ingress.Namespace, ingress.Name),
+	})
 	return records, nil
 }
 
-// NewIngressWatcher creates an IngressSource
-func NewIngressWatcher(factory informers.SharedInformerFactory, namespace string, notifyChan chan<- resource.Resource) IngressSource {
-	ingressInformer := factory.Networking().V1().Ingresses().Informer()
+// NewIngressWatcher creates an IngressSource which watches Ingresses using
+// factories, keyed by the namespace each factory is scoped to.
+func NewIngressWatcher(factories map[string]informers.SharedInformerFactory, namespaces *NamespaceFilter, filter *ObjectFilter, classes *IngressClassFilter, publishSvc *PublishService, hostnames *HostnameResolver, domain string, remapDomains []string, queue workqueue.Interface) *IngressSource {
+	metrics.InformerSynced.WithLabelValues("ingress").Set(0)
+
 	i := &IngressSource{
-		namespace:      namespace,
-		notifyChan:     notifyChan,
-		sharedInformer: ingressInformer,
+		domain:       domain,
+		remapDomains: remapDomains,
+		queue:        queue,
+		namespaces:   namespaces,
+		filter:       filter,
+		classes:      classes,
+		publishSvc:   publishSvc,
+		hostnames:    hostnames,
+		informers: newInformerSet(factories, func(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+			return factory.Networking().V1().Ingresses().Informer()
+		}),
 	}
 
-	ingressInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	i.namespaces.AddHandler(i.onNamespaceChange)
+	i.classes.AddHandler(i.enqueueAll)
+	i.publishSvc.AddHandler(i.enqueueAll)
+	i.hostnames.AddHandler(i.enqueueAll)
+	i.informers.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    i.onAdd,
 		DeleteFunc: i.onDelete,
 		UpdateFunc: i.onUpdate,
 	})
 
-	return *i
+	return i
 }
@@ -0,0 +1,117 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/networking/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// ingressClassAnnotation is the legacy annotation used to select the
+	// class of an Ingress before spec.ingressClassName was introduced
+	ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+	// defaultClassAnnotation marks the IngressClass used by Ingresses which do
+	// not specify a class
+	defaultClassAnnotation = "ingressclass.kubernetes.io/is-default-class"
+)
+
+// IngressClassFilter decides which Ingresses are published based on their
+// class. Ingresses may be selected by class name, or by the controller named
+// in their IngressClass.
+type IngressClassFilter struct {
+	classes     map[string]struct{}
+	controllers map[string]struct{}
+	informer    cache.SharedIndexInformer // nil unless controllers is set
+	notifier
+}
+
+// HasSynced reports whether the IngressClass informer cache has synced
+func (f *IngressClassFilter) HasSynced() bool {
+	return f.informer == nil || f.informer.HasSynced()
+}
+
+// Matches reports whether the records for ingress may be published
+func (f *IngressClassFilter) Matches(ingress *v1.Ingress) bool {
+	if len(f.classes) == 0 && len(f.controllers) == 0 {
+		return true
+	}
+
+	className := ingress.Annotations[ingressClassAnnotation]
+	if ingress.Spec.IngressClassName != nil {
+		className = *ingress.Spec.IngressClassName
+	}
+	if _, ok := f.classes[className]; ok && className != "" {
+		return true
+	}
+	if f.informer == nil {
+		return false
+	}
+
+	class := f.defaultClass()
+	if className != "" {
+		obj, exists, err := f.informer.GetStore().GetByKey(className)
+		if err != nil || !exists {
+			return false
+		}
+		class, _ = obj.(*v1.IngressClass)
+	}
+	if class == nil {
+		return false
+	}
+	_, ok := f.controllers[class.Spec.Controller]
+	return ok
+}
+
+// defaultClass returns the IngressClass marked as the default, if any
+func (f *IngressClassFilter) defaultClass() *v1.IngressClass {
+	for _, obj := range f.informer.GetStore().List() {
+		class, ok := obj.(*v1.IngressClass)
+		if ok && strings.EqualFold(class.Annotations[defaultClassAnnotation], "true") {
+			return class
+		}
+	}
+	return nil
+}
+
+// NewIngressClassFilter creates an IngressClassFilter matching Ingresses of
+// the given classes, or whose IngressClass names one of controllers.
+func NewIngressClassFilter(factory informers.SharedInformerFactory, classes, controllers []string) *IngressClassFilter {
+	f := &IngressClassFilter{
+		classes:     make(map[string]struct{}, len(classes)),
+		controllers: make(map[string]struct{}, len(controllers)),
+	}
+	for _, class := range classes {
+		f.classes[class] = struct{}{}
+	}
+	for _, controller := range controllers {
+		f.controllers[controller] = struct{}{}
+	}
+
+	if len(controllers) > 0 {
+		f.informer = factory.Networking().V1().IngressClasses().Informer()
+		f.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(interface{}) { f.notify() },
+			DeleteFunc: func(interface{}) { f.notify() },
+			UpdateFunc: func(interface{}, interface{}) { f.notify() },
+		})
+	}
+
+	return f
+}
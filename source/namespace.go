@@ -0,0 +1,123 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"github.com/blake/external-mdns/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// NamespaceFilter decides which namespaces objects are published from.
+// Namespaces may be excluded by name, or selected by their labels.
+type NamespaceFilter struct {
+	excluded map[string]struct{}
+	selector labels.Selector
+	informer cache.SharedIndexInformer // nil unless selector is set
+	handlers []func(namespace string)
+}
+
+// Run waits for the Namespace informer cache to sync, if namespaces are
+// selected by label. The informer is started by the factory it was created
+// from.
+func (f *NamespaceFilter) Run(stopCh <-chan struct{}) {
+	if f.informer == nil {
+		return
+	}
+	if cache.WaitForCacheSync(stopCh, f.informer.HasSynced) {
+		metrics.InformerSynced.WithLabelValues("namespace").Set(1)
+	}
+}
+
+// HasSynced reports whether the Namespace informer cache has synced
+func (f *NamespaceFilter) HasSynced() bool {
+	return f.informer == nil || f.informer.HasSynced()
+}
+
+// Allowed reports whether objects in namespace may be published
+func (f *NamespaceFilter) Allowed(namespace string) bool {
+	if _, ok := f.excluded[namespace]; ok {
+		return false
+	}
+	if f.informer == nil {
+		return true
+	}
+
+	obj, exists, err := f.informer.GetStore().GetByKey(namespace)
+	if err != nil || !exists {
+		return false
+	}
+	ns, ok := obj.(*corev1.Namespace)
+	return ok && f.selector.Matches(labels.Set(ns.Labels))
+}
+
+// AddHandler registers handler to be called with each namespace which becomes
+// allowed or disallowed
+func (f *NamespaceFilter) AddHandler(handler func(namespace string)) {
+	f.handlers = append(f.handlers, handler)
+}
+
+func (f *NamespaceFilter) notify(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return
+	}
+	for _, handler := range f.handlers {
+		handler(ns.Name)
+	}
+}
+
+func (f *NamespaceFilter) onUpdate(oldObj interface{}, newObj interface{}) {
+	oldNS, ok := oldObj.(*corev1.Namespace)
+	if !ok {
+		return
+	}
+	newNS, ok := newObj.(*corev1.Namespace)
+	if !ok {
+		return
+	}
+	if f.selector.Matches(labels.Set(oldNS.Labels)) != f.selector.Matches(labels.Set(newNS.Labels)) {
+		f.notify(newObj)
+	}
+}
+
+// NewNamespaceFilter creates a NamespaceFilter which disallows excluded, and
+// namespaces whose labels do not match selector if it is not nil.
+func NewNamespaceFilter(factory informers.SharedInformerFactory, excluded []string, selector labels.Selector) *NamespaceFilter {
+	f := &NamespaceFilter{
+		excluded: make(map[string]struct{}, len(excluded)),
+		selector: selector,
+	}
+	for _, namespace := range excluded {
+		f.excluded[namespace] = struct{}{}
+	}
+
+	if selector != nil {
+		metrics.InformerSynced.WithLabelValues("namespace").Set(0)
+		f.informer = factory.Core().V1().Namespaces().Informer()
+		f.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    f.notify,
+			DeleteFunc: f.notify,
+			UpdateFunc: f.onUpdate,
+		})
+	}
+
+	return f
+}
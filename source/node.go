@@ -0,0 +1,147 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blake/external-mdns/metrics"
+	"github.com/blake/external-mdns/resource"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// NodeSource provides the mDNS record advertisements for Nodes, so that each
+// Node can be reached by name
+type NodeSource struct {
+	selector       labels.Selector
+	queue          workqueue.Interface
+	sharedInformer cache.SharedIndexInformer
+}
+
+// Run waits for the Node informer cache to synchronize. The informer is started
+// by the factory it was created from.
+func (n *NodeSource) Run(stopCh chan struct{}) error {
+	if !cache.WaitForCacheSync(stopCh, n.sharedInformer.HasSynced) {
+		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
+		return nil
+	}
+	metrics.InformerSynced.WithLabelValues("node").Set(1)
+
+	<-stopCh
+	return nil
+}
+
+// HasSynced reports whether the informer cache has synced
+func (n *NodeSource) HasSynced() bool {
+	return n.sharedInformer.HasSynced()
+}
+
+// Resources returns the resources to advertise for every Node in the informer
+// cache
+func (n *NodeSource) Resources() ([]resource.Resource, error) {
+	var resources []resource.Resource
+	for _, obj := range n.sharedInformer.GetStore().List() {
+		if advertiseResource, ok := n.buildRecord(obj); ok {
+			resources = append(resources, advertiseResource)
+		}
+	}
+	return resources, nil
+}
+
+// ResourcesFor returns the resources to advertise for a single Node. Nodes are
+// cluster-scoped, so namespace is always empty.
+func (n *NodeSource) ResourcesFor(namespace, name string) ([]resource.Resource, error) {
+	obj, exists, err := n.sharedInformer.GetStore().GetByKey(storeKey(namespace, name))
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	if advertiseResource, ok := n.buildRecord(obj); ok {
+		return []resource.Resource{advertiseResource}, nil
+	}
+	return nil, nil
+}
+
+func (n *NodeSource) onAdd(obj interface{}) {
+	metrics.KubernetesEvents.WithLabelValues("node", "add").Inc()
+	enqueue(n.queue, "node", obj)
+}
+
+func (n *NodeSource) onDelete(obj interface{}) {
+	metrics.KubernetesEvents.WithLabelValues("node", "delete").Inc()
+	enqueue(n.queue, "node", obj)
+}
+
+func (n *NodeSource) onUpdate(oldObj interface{}, newObj interface{}) {
+	metrics.KubernetesEvents.WithLabelValues("node", "update").Inc()
+	enqueue(n.queue, "node", newObj)
+}
+
+// buildRecord returns the resource to advertise for a Node, and whether it
+// should be published. Ready Nodes matching the selector are published under
+// the first label of their name, using their InternalIP addresses.
+func (n *NodeSource) buildRecord(obj interface{}) (resource.Resource, bool) {
+	node, ok := obj.(*corev1.Node)
+	if !ok || optedOut(node.Annotations) || !nodeReady(node) || !n.selector.Matches(labels.Set(node.Labels)) {
+		return resource.Resource{}, false
+	}
+
+	var ips []string
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP {
+			ips = append(ips, addr.Address)
+		}
+	}
+	if len(ips) == 0 {
+		return resource.Resource{}, false
+	}
+
+	return resource.Resource{
+		SourceType: "node",
+		ObjectName: node.Name,
+		IPs:        ips,
+		Names:      []string{strings.SplitN(node.Name, ".", 2)[0]},
+		TTL:        annotationTTL(node.Annotations, "node", node.Namespace, node.Name),
+	}, true
+}
+
+// NewNodeWatcher creates a NodeSource publishing the ready Nodes which match
+// selector, watched using a cluster-wide factory.
+func NewNodeWatcher(factory informers.SharedInformerFactory, selector labels.Selector, queue workqueue.Interface) *NodeSource {
+	metrics.InformerSynced.WithLabelValues("node").Set(0)
+
+	n := &NodeSource{
+		selector:       selector,
+		queue:          queue,
+		sharedInformer: factory.Core().V1().Nodes().Informer(),
+	}
+	if n.selector == nil {
+		n.selector = labels.Everything()
+	}
+
+	n.sharedInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    n.onAdd,
+		DeleteFunc: n.onDelete,
+		UpdateFunc: n.onUpdate,
+	})
+
+	return n
+}
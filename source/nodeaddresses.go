@@ -0,0 +1,106 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"reflect"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// NodeAddresses supplies the addresses of the ready Nodes matching a label
+// selector, which are published for NodePort Services
+type NodeAddresses struct {
+	selector labels.Selector
+	informer cache.SharedIndexInformer // nil unless enabled
+	notifier
+}
+
+// HasSynced reports whether the Node informer cache has synced
+func (n *NodeAddresses) HasSynced() bool {
+	return n.informer == nil || n.informer.HasSynced()
+}
+
+// Addresses returns the InternalIP and ExternalIP addresses of every ready
+// Node matching the selector
+func (n *NodeAddresses) Addresses() []string {
+	if n.informer == nil {
+		return nil
+	}
+
+	var addrs []string
+	for _, obj := range n.informer.GetStore().List() {
+		addrs = append(addrs, n.nodeAddresses(obj)...)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// nodeAddresses returns the addresses to publish for a single Node, if it is
+// ready and matches the selector
+func (n *NodeAddresses) nodeAddresses(obj interface{}) []string {
+	node, ok := obj.(*corev1.Node)
+	if !ok || !nodeReady(node) || !n.selector.Matches(labels.Set(node.Labels)) {
+		return nil
+	}
+
+	var addrs []string
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP || addr.Type == corev1.NodeExternalIP {
+			addrs = append(addrs, addr.Address)
+		}
+	}
+	return addrs
+}
+
+// nodeReady reports whether the Ready condition of node is true
+func nodeReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func (n *NodeAddresses) onUpdate(oldObj interface{}, newObj interface{}) {
+	if !reflect.DeepEqual(n.nodeAddresses(oldObj), n.nodeAddresses(newObj)) {
+		n.notify()
+	}
+}
+
+// NewNodeAddresses creates a NodeAddresses for Nodes matching selector, which
+// supplies no addresses unless enabled is true.
+func NewNodeAddresses(factory informers.SharedInformerFactory, selector labels.Selector, enabled bool) *NodeAddresses {
+	n := &NodeAddresses{selector: selector}
+	if n.selector == nil {
+		n.selector = labels.Everything()
+	}
+
+	if enabled {
+		n.informer = factory.Core().V1().Nodes().Informer()
+		n.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(interface{}) { n.notify() },
+			DeleteFunc: func(interface{}) { n.notify() },
+			UpdateFunc: n.onUpdate,
+		})
+	}
+
+	return n
+}
@@ -0,0 +1,32 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+// notifier calls its handlers whenever the state it is embedded in changes
+type notifier struct {
+	handlers []func()
+}
+
+// AddHandler registers handler to be called on every change. Handlers must be
+// added before Run.
+func (n *notifier) AddHandler(handler func()) {
+	n.handlers = append(n.handlers, handler)
+}
+
+func (n *notifier) notify() {
+	for _, handler := range n.handlers {
+		handler()
+	}
+}
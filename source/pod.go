@@ -0,0 +1,181 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blake/external-mdns/metrics"
+	"github.com/blake/external-mdns/resource"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// PodSource provides the mDNS record advertisements for Pods, such as those
+// using the host network, which are not exposed by a Service
+type PodSource struct {
+	queue      workqueue.Interface
+	informers  informerSet
+	namespaces *NamespaceFilter
+	filter     *ObjectFilter
+}
+
+// Run starts the informer for each watched namespace and waits for their
+// caches to synchronize.
+func (p *PodSource) Run(stopCh chan struct{}) error {
+	p.informers.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, p.HasSynced) {
+		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
+		return nil
+	}
+	metrics.InformerSynced.WithLabelValues("pod").Set(1)
+
+	<-stopCh
+	return nil
+}
+
+// HasSynced reports whether the informer caches have synced
+func (p *PodSource) HasSynced() bool {
+	return p.informers.HasSynced() && p.namespaces.HasSynced()
+}
+
+// Resources returns the resources to advertise for every Pod in the informer
+// caches
+func (p *PodSource) Resources() ([]resource.Resource, error) {
+	var resources []resource.Resource
+	for _, obj := range p.informers.List() {
+		if !p.namespaces.Allowed(objectNamespace(obj)) || !p.filter.Matches(obj) {
+			continue
+		}
+		if advertiseResource, ok := p.buildRecord(obj); ok {
+			resources = append(resources, advertiseResource)
+		}
+	}
+	return resources, nil
+}
+
+// ResourcesFor returns the resources to advertise for a single Pod
+func (p *PodSource) ResourcesFor(namespace, name string) ([]resource.Resource, error) {
+	if !p.namespaces.Allowed(namespace) {
+		return nil, nil
+	}
+
+	obj, exists, err := p.informers.GetByKey(namespace, name)
+	if err != nil || !exists {
+		return nil, err
+	}
+	if !p.filter.Matches(obj) {
+		return nil, nil
+	}
+
+	if advertiseResource, ok := p.buildRecord(obj); ok {
+		return []resource.Resource{advertiseResource}, nil
+	}
+	return nil, nil
+}
+
+// onNamespaceChange queues every Pod in a namespace which became allowed or
+// disallowed
+func (p *PodSource) onNamespaceChange(namespace string) {
+	for _, obj := range p.informers.ListNamespace(namespace) {
+		enqueue(p.queue, "pod", obj)
+	}
+}
+
+func (p *PodSource) onAdd(obj interface{}) {
+	metrics.KubernetesEvents.WithLabelValues("pod", "add").Inc()
+	enqueue(p.queue, "pod", obj)
+}
+
+func (p *PodSource) onDelete(obj interface{}) {
+	metrics.KubernetesEvents.WithLabelValues("pod", "delete").Inc()
+	enqueue(p.queue, "pod", obj)
+}
+
+func (p *PodSource) onUpdate(oldObj interface{}, newObj interface{}) {
+	metrics.KubernetesEvents.WithLabelValues("pod", "update").Inc()
+	enqueue(p.queue, "pod", newObj)
+}
+
+// buildRecord returns the resource to advertise for a Pod, and whether it
+// should be published. Only running Pods with IPs which are annotated with
+// either EnabledAnnotation set to "true", or HostnamesAnnotation, are
+// published.
+func (p *PodSource) buildRecord(obj interface{}) (resource.Resource, bool) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Status.Phase != corev1.PodRunning {
+		return resource.Resource{}, false
+	}
+
+	names, hasHostnames := annotationHostnames(pod.Annotations)
+	if !hasHostnames {
+		if !strings.EqualFold(pod.Annotations[EnabledAnnotation], "true") {
+			return resource.Resource{}, false
+		}
+		names = []string{pod.Name}
+	}
+	if optedOut(pod.Annotations) {
+		return resource.Resource{}, false
+	}
+
+	var ips []string
+	for _, podIP := range pod.Status.PodIPs {
+		ips = append(ips, podIP.IP)
+	}
+	if len(ips) == 0 && pod.Status.PodIP != "" {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	if len(ips) == 0 {
+		return resource.Resource{}, false
+	}
+
+	return resource.Resource{
+		SourceType:       "pod",
+		ObjectName:       pod.Name,
+		IPs:              ips,
+		Names:            names,
+		Namespace:        pod.Namespace,
+		WithoutNamespace: annotationWithoutNamespace(pod.Annotations, false),
+		TTL:              annotationTTL(pod.Annotations, "pod", pod.Namespace, pod.Name),
+	}, true
+}
+
+// NewPodWatcher creates a PodSource which watches Pods using factories, keyed
+// by the namespace each factory is scoped to.
+func NewPodWatcher(factories map[string]informers.SharedInformerFactory, namespaces *NamespaceFilter, filter *ObjectFilter, queue workqueue.Interface) *PodSource {
+	metrics.InformerSynced.WithLabelValues("pod").Set(0)
+
+	p := &PodSource{
+		queue:      queue,
+		namespaces: namespaces,
+		filter:     filter,
+		informers: newInformerSet(factories, func(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+			return factory.Core().V1().Pods().Informer()
+		}),
+	}
+
+	p.namespaces.AddHandler(p.onNamespaceChange)
+	p.informers.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    p.onAdd,
+		DeleteFunc: p.onDelete,
+		UpdateFunc: p.onUpdate,
+	})
+
+	return p
+}
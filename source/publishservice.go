@@ -0,0 +1,123 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// PublishService supplies the addresses of a single Service, such as the one
+// exposing an Ingress controller, as the addresses of every Ingress
+type PublishService struct {
+	namespace string
+	name      string
+	informer  cache.SharedIndexInformer // nil unless a Service is configured
+	hostnames *HostnameResolver
+	notifier
+}
+
+// Run starts the Service informer
+func (p *PublishService) Run(stopCh <-chan struct{}) {
+	if p.informer != nil {
+		go p.informer.Run(stopCh)
+	}
+}
+
+// HasSynced reports whether the Service informer cache has synced
+func (p *PublishService) HasSynced() bool {
+	return p.informer == nil || p.informer.HasSynced()
+}
+
+// Enabled reports whether a Service is configured
+func (p *PublishService) Enabled() bool {
+	return p.informer != nil
+}
+
+// Targets returns the addresses, and the CNAME targets, to publish for the
+// load balancer entries and external IPs of the Service
+func (p *PublishService) Targets() ([]string, []string) {
+	if p.informer == nil {
+		return nil, nil
+	}
+	obj, exists, err := p.informer.GetStore().GetByKey(storeKey(p.namespace, p.name))
+	if err != nil || !exists {
+		return nil, nil
+	}
+	service, ok := obj.(*corev1.Service)
+	if !ok {
+		return nil, nil
+	}
+	return p.hostnames.Targets(publishServiceStatus(service))
+}
+
+func (p *PublishService) onUpdate(oldObj interface{}, newObj interface{}) {
+	oldService, ok := oldObj.(*corev1.Service)
+	if !ok {
+		return
+	}
+	newService, ok := newObj.(*corev1.Service)
+	if !ok {
+		return
+	}
+	if !reflect.DeepEqual(publishServiceStatus(oldService), publishServiceStatus(newService)) {
+		p.notify()
+	}
+}
+
+// publishServiceStatus returns the load balancer entries of service, with its
+// external IPs added as further entries
+func publishServiceStatus(service *corev1.Service) corev1.LoadBalancerStatus {
+	status := corev1.LoadBalancerStatus{
+		Ingress: append([]corev1.LoadBalancerIngress(nil), service.Status.LoadBalancer.Ingress...),
+	}
+	for _, ip := range service.Spec.ExternalIPs {
+		status.Ingress = append(status.Ingress, corev1.LoadBalancerIngress{IP: ip})
+	}
+	return status
+}
+
+// NewPublishService creates a PublishService for the Service identified by
+// key, in the form namespace/name, or a disabled one if key is empty.
+func NewPublishService(client kubernetes.Interface, key string, hostnames *HostnameResolver) (*PublishService, error) {
+	if key == "" {
+		return &PublishService{}, nil
+	}
+
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid publish service %q: expected namespace/name", key)
+	}
+
+	p := &PublishService{namespace: parts[0], name: parts[1], hostnames: hostnames}
+	p.informer = coreinformers.NewFilteredServiceInformer(client, p.namespace, 0, cache.Indexers{}, func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", p.name).String()
+	})
+	p.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { p.notify() },
+		DeleteFunc: func(interface{}) { p.notify() },
+		UpdateFunc: p.onUpdate,
+	})
+
+	return p, nil
+}
@@ -18,128 +18,235 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/blake/external-mdns/metrics"
 	"github.com/blake/external-mdns/resource"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
-// ServiceSource handles adding, updating, or removing mDNS record advertisements
+// ServiceSourceOptions controls which Services, and which of their addresses,
+// are published
+type ServiceSourceOptions struct {
+	PublishInternal     bool // Publish the cluster IP of ClusterIP Services
+	PublishExternalName bool // Publish ExternalName Services as CNAME records
+	PublishHeadless     bool // Publish the endpoints of annotated headless Services
+	RequireReady        bool // Only publish Services which select Pods while an endpoint is ready
+}
+
+// ServiceSource provides the mDNS record advertisements for Services
 type ServiceSource struct {
-	namespace       string
-	publishInternal bool
-	notifyChan      chan<- resource.Resource
-	sharedInformer  cache.SharedIndexInformer
+	opts       ServiceSourceOptions
+	queue      workqueue.Interface
+	informers  informerSet
+	namespaces *NamespaceFilter
+	filter     *ObjectFilter
+	hostnames  *HostnameResolver
+	nodes      *NodeAddresses
+	endpoints  informerSet // nil unless EndpointSlices are watched
 }
 
-// Run starts shared informers and waits for the shared informer cache to
-// synchronize.
+// Run starts the informer for each watched namespace and waits for their
+// caches to synchronize.
 func (s *ServiceSource) Run(stopCh chan struct{}) error {
-	s.sharedInformer.Run(stopCh)
-	if !cache.WaitForCacheSync(stopCh, s.sharedInformer.HasSynced) {
+	s.informers.Run(stopCh)
+	s.endpoints.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, s.HasSynced) {
 		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
+		return nil
 	}
+	metrics.InformerSynced.WithLabelValues("service").Set(1)
+
+	<-stopCh
 	return nil
 }
 
-func (s *ServiceSource) onAdd(obj interface{}) {
-	advertiseResource, err := s.buildRecord(obj, resource.Added)
+// HasSynced reports whether the informer caches have synced
+func (s *ServiceSource) HasSynced() bool {
+	return s.informers.HasSynced() && s.namespaces.HasSynced() && s.nodes.HasSynced() && s.endpoints.HasSynced()
+}
 
-	if err != nil {
-		for _, name := range advertiseResource.Names {
-			fmt.Printf("updating, %s", name)
+// Resources returns the resources to advertise for every Service in the
+// informer caches
+func (s *ServiceSource) Resources() ([]resource.Resource, error) {
+	var resources []resource.Resource
+	for _, obj := range s.informers.List() {
+		if !s.namespaces.Allowed(objectNamespace(obj)) || !s.filter.Matches(obj) {
+			continue
 		}
+		advertiseResources, err := s.resourcesFor(obj)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, advertiseResources...)
 	}
+	return resources, nil
+}
 
-	if len(advertiseResource.IPs) == 0 {
-		return
+// ResourcesFor returns the resources to advertise for a single Service
+func (s *ServiceSource) ResourcesFor(namespace, name string) ([]resource.Resource, error) {
+	if !s.namespaces.Allowed(namespace) {
+		return nil, nil
 	}
 
-	s.notifyChan <- advertiseResource
-}
+	obj, exists, err := s.informers.GetByKey(namespace, name)
+	if err != nil || !exists {
+		return nil, err
+	}
+	if !s.filter.Matches(obj) {
+		return nil, nil
+	}
 
-func (s *ServiceSource) onDelete(obj interface{}) {
-	advertiseResource, err := s.buildRecord(obj, resource.Deleted)
+	return s.resourcesFor(obj)
+}
 
+// resourcesFor returns the resources with addresses to advertise for a Service
+func (s *ServiceSource) resourcesFor(obj interface{}) ([]resource.Resource, error) {
+	advertiseResource, err := s.buildRecord(obj)
 	if err != nil {
-		for _, name := range advertiseResource.Names {
-			fmt.Printf("Error deleting, %s", name)
+		return nil, err
+	}
+
+	service, ok := obj.(*corev1.Service)
+	if !ok {
+		return nil, nil
+	}
+
+	// Services which select Pods are withdrawn while none of them are ready
+	if s.opts.RequireReady && len(service.Spec.Selector) > 0 {
+		ready, err := s.hasReadyEndpoint(service)
+		if err != nil || !ready {
+			return nil, err
+		}
+	}
+
+	resources := []resource.Resource{advertiseResource}
+	if s.publishEndpoints(service) && !optedOut(service.Annotations) {
+		if resources, err = s.endpointResources(service, advertiseResource); err != nil {
+			return nil, err
 		}
 	}
-	s.notifyChan <- advertiseResource
+
+	published := make([]resource.Resource, 0, len(resources))
+	for _, r := range resources {
+		if r.HasAddresses() {
+			published = append(published, r)
+		}
+	}
+	return published, nil
 }
 
-func (s *ServiceSource) onUpdate(oldObj interface{}, newObj interface{}) {
-	oldResource, err1 := s.buildRecord(oldObj, resource.Deleted)
-	if err1 != nil {
-		fmt.Printf("Error parsing old service resource: %s", err1)
+// onNamespaceChange queues every Service in a namespace which became allowed or
+// disallowed
+func (s *ServiceSource) onNamespaceChange(namespace string) {
+	for _, obj := range s.informers.ListNamespace(namespace) {
+		enqueue(s.queue, "service", obj)
 	}
-	s.notifyChan <- oldResource
+}
 
-	newResource, err2 := s.buildRecord(newObj, resource.Added)
-	if err2 != nil {
-		fmt.Printf("Error parsing new service resource: %s", err2)
+// enqueueAll queues every Service. It is called when the addresses of a load
+// balancer hostname, or of the Nodes published for NodePort Services, change.
+func (s *ServiceSource) enqueueAll() {
+	for _, obj := range s.informers.List() {
+		enqueue(s.queue, "service", obj)
 	}
-	s.notifyChan <- newResource
 }
 
-func (s *ServiceSource) buildRecord(obj interface{}, action string) (resource.Resource, error) {
+func (s *ServiceSource) onAdd(obj interface{}) {
+	metrics.KubernetesEvents.WithLabelValues("service", "add").Inc()
+	enqueue(s.queue, "service", obj)
+}
+
+func (s *ServiceSource) onDelete(obj interface{}) {
+	metrics.KubernetesEvents.WithLabelValues("service", "delete").Inc()
+	enqueue(s.queue, "service", obj)
+}
+
+func (s *ServiceSource) onUpdate(oldObj interface{}, newObj interface{}) {
+	metrics.KubernetesEvents.WithLabelValues("service", "update").Inc()
+	enqueue(s.queue, "service", newObj)
+}
+
+func (s *ServiceSource) buildRecord(obj interface{}) (resource.Resource, error) {
 
 	var advertiseObj = resource.Resource{
 		SourceType: "service",
-		Action:     action,
 	}
 
 	service, ok := obj.(*corev1.Service)
 
-	if !ok {
+	if !ok || optedOut(service.Annotations) {
 		return advertiseObj, nil
 	}
 
-	if hostnames, ok := service.Annotations["external-mdns.blakecovarrubias.com/hostnames"]; ok {
-		names := strings.Split(hostnames, ",")
-		for i := range names {
-			names[i] = strings.TrimSpace(names[i])
-		}
+	if names, ok := annotationHostnames(service.Annotations); ok {
 		advertiseObj.Names = names
 	} else {
 		advertiseObj.Names = []string{service.Name}
 	}
-	if withoutNS, ok := service.Annotations["external-mdns.blakecovarrubias.com/without-namespace"]; ok {
-		advertiseObj.WithoutNamespace = strings.EqualFold(withoutNS, "true")
-	}
+	advertiseObj.WithoutNamespace = annotationWithoutNamespace(service.Annotations, false)
 
+	advertiseObj.ObjectName = service.Name
 	advertiseObj.Namespace = service.Namespace
+	advertiseObj.TTL = annotationTTL(service.Annotations, "service", service.Namespace, service.Name)
 	advertiseObj.IPs = []string{}
 
-	if service.Spec.Type == "ClusterIP" && s.publishInternal {
+	publishInternal := s.opts.PublishInternal || strings.EqualFold(service.Annotations[PublishInternalAnnotation], "true")
+	if service.Spec.Type == "ClusterIP" && service.Spec.ClusterIP != corev1.ClusterIPNone && publishInternal {
 		advertiseObj.IPs = append(advertiseObj.IPs, service.Spec.ClusterIP)
 	} else if service.Spec.Type == "LoadBalancer" {
-		for _, lb := range service.Status.LoadBalancer.Ingress {
-			if lb.IP != "" {
-				advertiseObj.IPs = append(advertiseObj.IPs, lb.IP)
-			}
-		}
+		ips, cnames := s.hostnames.Targets(service.Status.LoadBalancer)
+		advertiseObj.IPs = append(advertiseObj.IPs, ips...)
+		advertiseObj.Targets = cnames
+	} else if service.Spec.Type == "NodePort" {
+		advertiseObj.IPs = append(advertiseObj.IPs, s.nodes.Addresses()...)
+	} else if service.Spec.Type == "ExternalName" && s.opts.PublishExternalName {
+		advertiseObj.Targets = []string{service.Spec.ExternalName}
 	}
+	advertiseObj.IPs = append(advertiseObj.IPs, service.Spec.ExternalIPs...)
 
 	return advertiseObj, nil
 }
 
-// NewServicesWatcher creates an ServiceSource
-func NewServicesWatcher(factory informers.SharedInformerFactory, namespace string, notifyChan chan<- resource.Resource, publishInternal *bool) ServiceSource {
-	servicesInformer := factory.Core().V1().Services().Informer()
+// NewServicesWatcher creates a ServiceSource which watches Services using
+// factories, keyed by the namespace each factory is scoped to.
+func NewServicesWatcher(factories map[string]informers.SharedInformerFactory, namespaces *NamespaceFilter, filter *ObjectFilter, hostnames *HostnameResolver, nodes *NodeAddresses, queue workqueue.Interface, opts ServiceSourceOptions) *ServiceSource {
+	metrics.InformerSynced.WithLabelValues("service").Set(0)
+
 	s := &ServiceSource{
-		namespace:       namespace,
-		publishInternal: *publishInternal,
-		notifyChan:      notifyChan,
-		sharedInformer:  servicesInformer,
+		opts:       opts,
+		queue:      queue,
+		namespaces: namespaces,
+		filter:     filter,
+		hostnames:  hostnames,
+		nodes:      nodes,
+		informers: newInformerSet(factories, func(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+			return factory.Core().V1().Services().Informer()
+		}),
+	}
+	s.namespaces.AddHandler(s.onNamespaceChange)
+	s.hostnames.AddHandler(s.enqueueAll)
+	s.nodes.AddHandler(s.enqueueAll)
+	if opts.PublishHeadless || opts.RequireReady {
+		s.endpoints = newInformerSet(factories, func(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+			return factory.Discovery().V1().EndpointSlices().Informer()
+		})
+		if err := s.endpoints.AddIndexers(cache.Indexers{serviceIndex: indexByService}); err != nil {
+			runtime.HandleError(err)
+		}
+		s.endpoints.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    s.onEndpointSliceChange,
+			DeleteFunc: s.onEndpointSliceChange,
+			UpdateFunc: func(oldObj, newObj interface{}) { s.onEndpointSliceChange(newObj) },
+		})
 	}
-	servicesInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	s.informers.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    s.onAdd,
 		DeleteFunc: s.onDelete,
 		UpdateFunc: s.onUpdate,
 	})
 
-	return *s
+	return s
 }
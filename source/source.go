@@ -0,0 +1,88 @@
+// Copyright 2020 Blake Covarrubias
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"strings"
+
+	"github.com/blake/external-mdns/resource"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Source provides the resources to advertise for a type of Kubernetes object
+type Source interface {
+	// Run starts the source's informers and blocks until stopCh is closed
+	Run(stopCh chan struct{}) error
+
+	// HasSynced reports whether the source's informer caches have synced
+	HasSynced() bool
+
+	// Resources returns the resources to advertise for every object currently
+	// in the source's informer caches
+	Resources() ([]resource.Resource, error)
+
+	// ResourcesFor returns the resources to advertise for a single object. No
+	// resources are returned if the object does not exist.
+	ResourcesFor(namespace, name string) ([]resource.Resource, error)
+}
+
+// enqueue adds the owner key of obj to queue so that its records are
+// reconciled by a worker
+func enqueue(queue workqueue.Interface, sourceType string, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	queue.Add(resource.OwnerKey(sourceType, accessor.GetNamespace(), accessor.GetName()))
+}
+
+// storeKey returns the key of an object in an informer store
+func storeKey(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// objectNamespace returns the namespace of obj
+func objectNamespace(obj interface{}) string {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
+	}
+	return accessor.GetNamespace()
+}
+
+// trimDomain removes the published domain, or any of the domains which are
+// remapped into it, from host. It returns false if host is not within one of
+// these domains.
+func trimDomain(host, domain string, remapDomains []string) (string, bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range append([]string{domain}, remapDomains...) {
+		suffix := "." + strings.Trim(strings.ToLower(d), ".")
+		if name := strings.TrimSuffix(host, suffix); name != host && name != "" {
+			return name, true
+		}
+	}
+	return "", false
+}